@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 离线批量处理backend里的文件（import、convert）：并行处理、每秒显示进度，
+// 收到SIGINT、SIGTERM时等正在处理的文件完成后停止，重新运行可以继续
+type batch struct {
+	tag        string // 输出的前缀，例如import
+	ratioLabel string // 进度里bytesOut/bytesIn的说明，为空时不显示
+	workers    int
+	quiet      bool // 不显示进度
+
+	totalFiles int64
+	totalBytes int64
+	doneFiles  atomic.Int64 // 已经处理的文件数（包括跳过的）
+	skipped    atomic.Int64 // 不需要处理、跳过的文件数
+	failed     atomic.Int64
+	bytesIn    atomic.Int64 // 已经处理的文件处理前的大小
+	bytesOut   atomic.Int64 // 已经处理的文件处理后的大小
+	stopped    atomic.Bool  // 收到SIGINT、SIGTERM后不再开始新的文件
+}
+
+// 用b.workers个goroutine对0到n-1调用process，直到全部完成。被中断的话返回false
+func (b *batch) run(n int, process func(i int)) bool {
+	// 再收到一次信号马上退出，留下的临时文件下次运行（或者挂载）时删除
+	exitChan := make(chan os.Signal, 1)
+	signal.Notify(exitChan, syscall.SIGINT, syscall.SIGTERM)
+	defer func() {
+		signal.Stop(exitChan)
+		close(exitChan)
+	}()
+	go func() {
+		if _, ok := <-exitChan; !ok {
+			return
+		}
+		fmt.Printf("\n[%s]中断，等待正在处理的文件完成……\n", b.tag)
+		b.stopped.Store(true)
+		if _, ok := <-exitChan; ok {
+			os.Exit(130)
+		}
+	}()
+
+	done := make(chan struct{})
+	var progress sync.WaitGroup
+	if !b.quiet {
+		progress.Add(1)
+		go func() {
+			defer progress.Done()
+			b.showProgress(done)
+		}()
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < b.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				process(i)
+				b.doneFiles.Add(1)
+			}
+		}()
+	}
+	for i := 0; i < n && !b.stopped.Load(); i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(done)
+	progress.Wait()
+	return !b.stopped.Load()
+}
+
+// 每秒显示一次进度，直到done关闭。输出到终端时在同一行刷新
+func (b *batch) showProgress(done <-chan struct{}) {
+	terminal := false
+	if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		terminal = true
+	}
+	show := func() {
+		in, out := b.bytesIn.Load(), b.bytesOut.Load()
+		ratio := ""
+		if b.ratioLabel != "" {
+			ratio = "，" + b.ratioLabel + formatRatio(out, in)
+		}
+		line := fmt.Sprintf("[%s]%d/%d个文件，%s/%s%s，失败%d个", b.tag,
+			b.doneFiles.Load(), b.totalFiles, formatSize(in), formatSize(b.totalBytes), ratio, b.failed.Load())
+		if terminal {
+			fmt.Print("\r\033[K" + line)
+		} else {
+			fmt.Println(line)
+		}
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			show()
+		case <-done:
+			show()
+			if terminal {
+				fmt.Println()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// 解压缓存目录，解压后的文件都放在这里（可以指向tmpfs或者本地SSD），不再放在BackendDir里
+var CacheDir string
+
+// 解压缓存的大小上限（字节），0表示不限制
+var CacheSize int64
+
+// 解压缓存的过期时间，超过这个时间没有访问的解压文件会被删除，0表示不按时间删除
+var CacheTTL time.Duration
+
+// 本次挂载实际使用的缓存目录：CacheDir/compressfs-<pid>，卸载时删除
+var cacheMountDir string
+
+// 解压缓存，记录已经占用的空间和有解压文件的File。
+// 文件关闭后解压文件不马上删除，而是按最后访问时间（LRU）和总大小淘汰。
+type rawCache struct {
+	mu    sync.Mutex
+	used  int64            // 所有解压文件大小的总和
+	files map[uint64]*File // inode到有解压文件的File的索引
+}
+
+var cache = rawCache{files: make(map[uint64]*File)}
+
+// 返回inode对应的解压文件路径
+func cachePath(inode uint64) string {
+	return filepath.Join(cacheMountDir, strconv.FormatUint(inode, 10)+".raw")
+}
+
+// 修改过、还没有压缩写回的解压文件旁边有一个同名的.path文件，记录它在backend里的路径。
+// 异常退出或者卸载时没能写回（例如磁盘满了）的话，下次挂载时按它把修改压缩写回
+func dirtyPath(inode uint64) string {
+	return filepath.Join(cacheMountDir, strconv.FormatUint(inode, 10)+".path")
+}
+
+// 缓存目录里记录它属于哪个backend（绝对路径）的文件。多个挂载可以共用同一个CacheDir，
+// 残留的缓存目录只能写回到它自己的backend
+const cacheBackendName = "backend"
+
+// 初始化缓存目录。每次挂载使用一个独立的子目录，之前异常退出时残留的子目录先把里面没有写回的修改写回，再删除。
+// 属于别的backend的残留目录不动，由那个backend下次挂载时处理
+func initCache() error {
+	if CacheDir == "" {
+		CacheDir = os.TempDir()
+	}
+	if err := os.MkdirAll(CacheDir, 0700); err != nil {
+		return err
+	}
+	backend, err := filepath.Abs(BackendDir)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(CacheDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), "compressfs-") {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimPrefix(e.Name(), "compressfs-"))
+		if err != nil {
+			continue
+		}
+		// 进程已经不存在，说明是残留的缓存
+		if syscall.Kill(pid, 0) == syscall.ESRCH {
+			dir := filepath.Join(CacheDir, e.Name())
+			if owner := cacheBackend(dir); owner != backend {
+				// 没有记录backend的目录里不会有要写回的修改，可以删除
+				if markers, _ := filepath.Glob(filepath.Join(dir, "*.path")); owner != "" || len(markers) > 0 {
+					fmt.Println("[initCache]残留的缓存目录", dir, "属于别的backend", owner, "，保留")
+					continue
+				}
+			} else if n := recoverCache(dir); n > 0 {
+				fmt.Println("[initCache]残留的缓存目录里还有", n, "个修改过的文件没有写回，保留", dir)
+				continue
+			}
+			fmt.Println("[initCache]删除残留的缓存目录", e.Name())
+			os.RemoveAll(dir)
+		}
+	}
+	cacheMountDir = filepath.Join(CacheDir, "compressfs-"+strconv.Itoa(os.Getpid()))
+	if err := os.MkdirAll(cacheMountDir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cacheMountDir, cacheBackendName), []byte(backend), 0600)
+}
+
+// 返回缓存目录dir属于的backend，没有记录时返回空
+func cacheBackend(dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, cacheBackendName))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// 把残留的缓存目录dir里修改过的文件压缩写回backend，返回没能写回的文件数
+func recoverCache(dir string) int {
+	markers, _ := filepath.Glob(filepath.Join(dir, "*.path"))
+	left := 0
+	for _, marker := range markers {
+		if err := recoverDirty(marker); err != nil {
+			fmt.Println("[ERROR]写回残留的修改失败！", marker, err)
+			left++
+		}
+	}
+	return left
+}
+
+// 按.path文件把旁边的解压文件压缩写回backend，写回后删除.path文件
+func recoverDirty(marker string) error {
+	if ReadOnly {
+		return fmt.Errorf("只读挂载")
+	}
+	rel, err := os.ReadFile(marker)
+	if err != nil {
+		return err
+	}
+	fr, err := os.Open(strings.TrimSuffix(marker, ".path") + ".raw")
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	fi, err := fr.Stat()
+	if err != nil {
+		return err
+	}
+	path := BackendDir + string(rel)
+	meta, _ := os.Stat(path)
+	if err := writeCompressed(path, fr, fi.Size(), CompressType, meta, true); err != nil {
+		return err
+	}
+	fmt.Println("[initCache]写回了残留的修改", string(rel), "Size:", fi.Size())
+	return os.Remove(marker)
+}
+
+// 卸载时删除本次挂载的缓存目录。还有没能写回的修改的话保留缓存目录（只删除没有修改的解压文件），下次挂载时写回
+func cleanCache() {
+	if cacheMountDir == "" {
+		return
+	}
+	if markers, _ := filepath.Glob(filepath.Join(cacheMountDir, "*.path")); len(markers) > 0 {
+		entries, _ := os.ReadDir(cacheMountDir)
+		for _, e := range entries {
+			base := strings.TrimSuffix(e.Name(), ".raw")
+			if base == e.Name() {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(cacheMountDir, base+".path")); os.IsNotExist(err) {
+				os.Remove(filepath.Join(cacheMountDir, e.Name()))
+			}
+		}
+		fmt.Println("[ERROR]有", len(markers), "个修改过的文件没能压缩写回，保留缓存目录", cacheMountDir, "，下次挂载时写回")
+		return
+	}
+	err := os.RemoveAll(cacheMountDir)
+	if err != nil {
+		fmt.Println("[ERROR]删除缓存目录失败！", err)
+	}
+}
+
+// 申请n字节的缓存空间，空间不够时先淘汰没有打开的解压文件，还是不够则返回 ENOSPC
+func (c *rawCache) reserve(n int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if CacheSize > 0 && n > 0 && c.used+n > CacheSize {
+		c.evictLocked(c.used+n-CacheSize, time.Time{})
+		if c.used+n > CacheSize {
+			// 修改过的文件不能淘汰，让后台尽快压缩
+			wb.kick()
+			return fuse.Errno(syscall.ENOSPC)
+		}
+	}
+	c.used += n
+	return nil
+}
+
+// 把有解压文件的File加入缓存索引
+func (c *rawCache) add(f *File) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[f.inode] = f
+}
+
+// 删除f的解压文件。调用时需持有f.mu
+func (c *rawCache) drop(f *File) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropLocked(f)
+}
+
+// 删除f的解压文件。调用时需持有f.mu和c.mu
+func (c *rawCache) dropLocked(f *File) {
+	if f.rawPath == "" {
+		return
+	}
+	err := os.Remove(f.rawPath)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("[ERROR]删除解压文件失败！", f.rawPath, err)
+	}
+	c.used -= f.rawSize
+	delete(c.files, f.inode)
+	f.rawPath = ""
+	f.rawSize = 0
+}
+
+// 缓存超过上限时，淘汰最久没有访问的解压文件
+func (c *rawCache) evict() {
+	if CacheSize <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictLocked(c.used-CacheSize, time.Time{})
+}
+
+// 按最后访问时间从旧到新淘汰没有打开、没有被修改的解压文件，直到释放need字节，
+// 并且所有在before之前访问的解压文件都被淘汰（before为零值时不按时间淘汰）。调用时需持有c.mu
+func (c *rawCache) evictLocked(need int64, before time.Time) {
+	type candidate struct {
+		f     *File
+		atime time.Time
+	}
+	var candidates []candidate
+	for _, f := range c.files {
+		// 正在被其他请求使用的文件直接跳过，避免死锁
+		if !f.mu.TryLock() {
+			continue
+		}
+		if f.openCount == 0 && !f.modified {
+			candidates = append(candidates, candidate{f, f.atime})
+		}
+		f.mu.Unlock()
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].atime.Before(candidates[j].atime) })
+	for _, cd := range candidates {
+		if need <= 0 && (before.IsZero() || !cd.atime.Before(before)) {
+			break
+		}
+		f := cd.f
+		if !f.mu.TryLock() {
+			continue
+		}
+		if f.openCount == 0 && !f.modified {
+			fmt.Println("[evict]淘汰解压缓存", f.fullPath+f.name, "Size:", f.rawSize, "atime:", f.atime.Format(time.RFC3339))
+			need -= f.rawSize
+			c.dropLocked(f)
+		}
+		f.mu.Unlock()
+	}
+}
+
+// 定期删除超过CacheTTL没有访问的解压文件
+func (c *rawCache) expireLoop() {
+	if CacheTTL <= 0 {
+		return
+	}
+	interval := CacheTTL / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	for range time.Tick(interval) {
+		c.mu.Lock()
+		c.evictLocked(0, time.Now().Add(-CacheTTL))
+		c.mu.Unlock()
+	}
+}
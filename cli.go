@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// 子命令
+type command struct {
+	name      string
+	args      string // 参数说明
+	summary   string // 英文说明
+	summaryZh string // 中文说明
+	run       func(cmd *command, args []string) int
+}
+
+// 所有子命令，按帮助里显示的顺序
+var commands = []*command{
+	{"mount", "[options] BACKEND MOUNTPOINT", "mount a backend directory", "挂载压缩文件目录", runMount},
+	{"umount", "[options] MOUNTPOINT", "unmount a compressfs mount", "卸载", runUmount},
+	{"import", "[options] SRC BACKEND", "compress an existing directory tree into a backend", "把已有的目录压缩导入到backend", runImport},
+	{"export", "[options] BACKEND DEST [paths...]", "decompress a backend into plain files", "把backend解压导出成普通文件", runExport},
+	{"cat", "[options] BACKEND PATH", "decompress a single backend file to stdout", "把backend里的一个文件解压输出到标准输出", runCat},
+	{"fsck", "[options] BACKEND", "check that every backend file decodes, and quarantine or repair damaged ones", "检查backend里的文件是否完整，可以隔离或者修复损坏的文件", runFsck},
+	{"scrub", "[options] BACKEND", "verify every block of every backend file and record the results", "校验backend里每个文件的每个数据块，并记录结果", runScrub},
+	{"stats", "[options] BACKEND", "show compression statistics of a backend", "显示backend的压缩统计", runStats},
+	{"convert", "[options] BACKEND", "recompress backend files with another codec", "把backend里的文件转换成另一种压缩方式", runConvert},
+}
+
+// 按名字查找子命令
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// 创建子命令的参数解析器，-h时打印子命令的帮助
+func (cmd *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", os.Args[0], cmd.name, cmd.args)
+		fmt.Fprintf(os.Stderr, "  %s\n  %s\n", cmd.summary, cmd.summaryZh)
+		fmt.Fprintf(os.Stderr, "Options / 选项：\n")
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// 解析子命令的参数并检查参数个数（max小于0表示不限制）。返回false时code为退出码
+func (cmd *command) parse(fs *flag.FlagSet, args []string, min, max int) (ok bool, code int) {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return false, 0
+		}
+		return false, 2
+	}
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		fs.Usage()
+		return false, 2
+	}
+	return true, 0
+}
+
+// mount的参数：压缩方式、配置文件和所有挂载选项
+func mountFlagSet(cmd *command) (*flag.FlagSet, func() error) {
+	fs := cmd.flagSet()
+	fs.StringVar(&CompressType, "codec", "lzw", help("codec for newly written files: lzw, flate1, flate9, flate, gzip, zlib, zstd, optionally with a level and parity, e.g. zstd:9 or zstd:9,parity=10%", "新写入文件的压缩方式：lzw、flate1、flate9、flate、gzip、zlib、zstd，可以带级别和纠错数据，例如zstd:9、zstd:9,parity=10%"))
+	fs.String("config", "", help("TOML config file describing one or more mounts; options given on the command line override it", "TOML配置文件，可以描述一个或多个挂载，命令行上的选项优先"))
+	fs.String("mount-name", "", help("with -config, mount only the [[mount]] with this name (or index)", "使用-config时，只挂载这个名字（或序号）的[[mount]]"))
+	return fs, addMountFlags(fs)
+}
+
+// compressfs mount [选项] BACKEND MOUNTPOINT
+// compressfs mount -config FILE [选项] [BACKEND MOUNTPOINT]
+func runMount(cmd *command, args []string) int {
+	fs, check := mountFlagSet(cmd)
+	if ok, code := cmd.parse(fs, args, 0, 2); !ok {
+		return code
+	}
+	configPath := fs.Lookup("config").Value.String()
+	if configPath == "" {
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return 2
+		}
+		BackendDir = fs.Arg(0)
+		Mountpoint = fs.Arg(1)
+		if err := check(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		return serve()
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	// 要挂载哪些：命令行上有BACKEND MOUNTPOINT的话只用配置文件的顶层设置
+	var indexes []int
+	if name := fs.Lookup("mount-name").Value.String(); fs.NArg() == 2 {
+		indexes = []int{-1}
+	} else if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	} else if name != "" {
+		i, err := cfg.findMount(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		indexes = []int{i}
+	} else {
+		for i := range cfg.mounts {
+			indexes = append(indexes, i)
+		}
+	}
+	if len(indexes) == 0 {
+		fmt.Fprintln(os.Stderr, "配置文件里没有[[mount]]，需要在命令行上指定BACKEND MOUNTPOINT")
+		return 2
+	}
+	// 先检查所有挂载的设置，有一个错误的话都不挂载
+	for _, i := range indexes {
+		if err := prepareMount(cmd, args, cfg, i); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	if len(indexes) > 1 {
+		return runMounts(cfg, indexes, args)
+	}
+	return serve()
+}
+
+// 挂载并运行，直到卸载
+func serve() int {
+	if err := run(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// compressfs umount [选项] MOUNTPOINT
+func runUmount(cmd *command, args []string) int {
+	fs := cmd.flagSet()
+	lazy := fs.Bool("lazy", false, help("detach the mount even if it is busy (requires root)", "即使挂载点正在使用也马上卸载（需要root）"))
+	if ok, code := cmd.parse(fs, args, 1, 1); !ok {
+		return code
+	}
+	var err error
+	if *lazy {
+		err = syscall.Unmount(fs.Arg(0), syscall.MNT_DETACH)
+	} else {
+		err = fuse.Unmount(fs.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]卸载失败！", err)
+		return 1
+	}
+	return 0
+}
+
+// backend的压缩统计
+type backendStats struct {
+	Files           int64            `json:"files"`
+	Dirs            int64            `json:"dirs"`
+	Specials        int64            `json:"specials"`
+	CompressedBytes int64            `json:"compressed_bytes"`
+	LogicalBytes    int64            `json:"logical_bytes"`
+	Codecs          map[string]int64 `json:"codecs"` // 每种压缩方式的文件数，旧格式的文件算作legacy
+	Errors          int64            `json:"errors"` // 读取失败的文件数
+}
+
+// compressfs stats [选项] BACKEND
+func runStats(cmd *command, args []string) int {
+	fs := cmd.flagSet()
+	checkLegacy := addLegacyCodecFlag(fs)
+	asJSON := fs.Bool("json", false, help("print the result as JSON", "以JSON格式输出"))
+	if ok, code := cmd.parse(fs, args, 1, 1); !ok {
+		return code
+	}
+	if err := checkLegacy(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	st, err := collectStats(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		return 1
+	}
+	if *asJSON {
+		out, _ := json.MarshalIndent(st, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	var codecs []string
+	for name, n := range st.Codecs {
+		codecs = append(codecs, fmt.Sprintf("%s=%d", name, n))
+	}
+	sort.Strings(codecs)
+	fmt.Printf("Files / 文件:             %d\n", st.Files)
+	fmt.Printf("Directories / 目录:       %d\n", st.Dirs)
+	fmt.Printf("Special files / 特殊文件: %d\n", st.Specials)
+	fmt.Printf("Compressed / 压缩后:      %s\n", formatSize(st.CompressedBytes))
+	fmt.Printf("Logical / 解压后:         %s\n", formatSize(st.LogicalBytes))
+	fmt.Printf("Ratio / 压缩率:           %s\n", formatRatio(st.CompressedBytes, st.LogicalBytes))
+	fmt.Printf("Codecs / 压缩方式:        %s\n", strings.Join(codecs, " "))
+	fmt.Printf("Errors / 错误:            %d\n", st.Errors)
+	return 0
+}
+
+// 遍历backend，统计文件数和压缩前后的大小
+func collectStats(backend string) (*backendStats, error) {
+	st := &backendStats{Codecs: make(map[string]int64)}
+	err := filepath.WalkDir(backend, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == backend {
+			return nil
+		}
+		if d.IsDir() {
+			if isMetaDir(backend, path) {
+				return fs.SkipDir
+			}
+			st.Dirs++
+			return nil
+		}
+		if isSpecialMode(d.Type()) {
+			st.Specials++
+			return nil
+		}
+		if isTempName(d.Name()) {
+			return nil
+		}
+		st.Files++
+		fi, err := d.Info()
+		if err != nil {
+			st.Errors++
+			return nil
+		}
+		st.CompressedBytes += fi.Size()
+		h, err := readFileHeader(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]", path, err)
+			st.Errors++
+			return nil
+		}
+		codec := "legacy"
+		if h != nil {
+			codec = h.codec
+		}
+		st.Codecs[codec]++
+		n, err := decodedSize(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]", path, err)
+			st.Errors++
+			return nil
+		}
+		st.LogicalBytes += n
+		return nil
+	})
+	return st, err
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+)
+
+// 配置文件（TOML）。顶层是所有挂载共用的设置，每个[[mount]]是一对backend和挂载目录，
+// 可以覆盖顶层的设置。设置项和mount的选项同名（下划线或者连字符都可以），命令行上的选项优先：
+//
+//	codec = "flate9"
+//	cache_dir = "/dev/shm"
+//	cache_size = "1G"
+//
+//	[[mount]]
+//	name = "data"
+//	backend = "/srv/backend/data"
+//	mountpoint = "/mnt/data"
+//
+//	[[mount]]
+//	backend = "/srv/backend/logs"
+//	mountpoint = "/mnt/logs"
+//	read_only = true
+type config struct {
+	global map[string]interface{}
+	mounts []map[string]interface{}
+}
+
+// 读取配置文件
+func loadConfig(path string) (*config, error) {
+	var raw map[string]interface{}
+	if _, err := toml.DecodeFile(path, &raw); err != nil {
+		return nil, fmt.Errorf("读取配置文件失败：%v", err)
+	}
+	cfg := &config{global: raw}
+	if v, ok := raw["mount"]; ok {
+		mounts, ok := v.([]map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("配置文件错误：mount必须是[[mount]]表")
+		}
+		cfg.mounts = mounts
+		delete(raw, "mount")
+	}
+	for _, key := range []string{"name", "backend", "mountpoint"} {
+		if _, ok := raw[key]; ok {
+			return nil, fmt.Errorf("配置文件错误：%s只能写在[[mount]]里", key)
+		}
+	}
+	seen := make(map[string]bool)
+	var backends []string
+	for i, m := range cfg.mounts {
+		for _, key := range []string{"backend", "mountpoint"} {
+			if s, ok := m[key].(string); !ok || s == "" {
+				return nil, fmt.Errorf("配置文件错误：第%d个[[mount]]缺少%s", i+1, key)
+			}
+		}
+		mp := strings.TrimSuffix(m["mountpoint"].(string), "/")
+		if seen[mp] {
+			return nil, fmt.Errorf("配置文件错误：挂载目录%s重复", mp)
+		}
+		seen[mp] = true
+		// 两个挂载共用（或者一个包含另一个）backend的话，互相看不到对方的修改，还会各自清理对方的临时文件
+		backend, err := filepath.Abs(m["backend"].(string))
+		if err != nil {
+			return nil, fmt.Errorf("配置文件错误：%v", err)
+		}
+		for _, other := range backends {
+			if pathContains(other, backend) || pathContains(backend, other) {
+				return nil, fmt.Errorf("配置文件错误：backend %s和%s重复或者互相包含", other, backend)
+			}
+		}
+		backends = append(backends, backend)
+	}
+	return cfg, nil
+}
+
+// dir是不是path本身或者path的上级目录，两个都必须是清理过的绝对路径
+func pathContains(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// 挂载的名字，没有写name的话用序号（从0开始）
+func (cfg *config) mountName(i int) string {
+	if name, ok := cfg.mounts[i]["name"].(string); ok && name != "" {
+		return name
+	}
+	return strconv.Itoa(i)
+}
+
+// 按名字或者序号查找挂载
+func (cfg *config) findMount(name string) (int, error) {
+	for i := range cfg.mounts {
+		if cfg.mountName(i) == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("配置文件里没有名为%s的挂载", name)
+}
+
+// 把配置里的设置应用到参数上，命令行上已经设置过的选项（set）不覆盖
+func applyConfig(fs *flag.FlagSet, set map[string]bool, values map[string]interface{}) error {
+	for key, v := range values {
+		switch key {
+		case "name", "backend", "mountpoint":
+			continue
+		}
+		name := strings.ReplaceAll(key, "_", "-")
+		switch name {
+		case "config", "mount-name":
+			return fmt.Errorf("配置文件错误：不能设置%s", key)
+		}
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("配置文件错误：未知的设置%s", key)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, fmt.Sprint(v)); err != nil {
+			return fmt.Errorf("配置文件错误：%s：%v", key, err)
+		}
+	}
+	return nil
+}
+
+// 用配置文件里的第index个挂载（index<0表示只用顶层设置，backend和挂载目录来自命令行）
+// 准备挂载：解析参数、合并配置、检查所有设置，并设置全局变量
+func prepareMount(cmd *command, args []string, cfg *config, index int) error {
+	fs, check := mountFlagSet(cmd)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if err := applyConfig(fs, set, cfg.global); err != nil {
+		return err
+	}
+	if index < 0 {
+		BackendDir = fs.Arg(0)
+		Mountpoint = fs.Arg(1)
+	} else {
+		m := cfg.mounts[index]
+		if err := applyConfig(fs, set, m); err != nil {
+			return fmt.Errorf("[[mount]] %s：%v", cfg.mountName(index), err)
+		}
+		BackendDir = m["backend"].(string)
+		Mountpoint = m["mountpoint"].(string)
+	}
+	if err := check(); err != nil {
+		if index >= 0 {
+			return fmt.Errorf("[[mount]] %s：%v", cfg.mountName(index), err)
+		}
+		return err
+	}
+	return nil
+}
+
+// 配置文件里有多个挂载：每个挂载启动一个子进程，收到SIGINT、SIGTERM时转发给所有子进程，等它们都退出
+func runMounts(cfg *config, indexes []int, args []string) int {
+	var children []*exec.Cmd
+	for _, i := range indexes {
+		child := exec.Command(os.Args[0], append(append([]string{"mount"}, args...), "-mount-name", cfg.mountName(i))...)
+		child.Stdout = os.Stdout
+		child.Stderr = os.Stderr
+		if err := child.Start(); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]启动挂载失败！", cfg.mountName(i), err)
+			for _, c := range children {
+				c.Process.Signal(syscall.SIGTERM)
+			}
+			break
+		}
+		fmt.Println("[mount]", cfg.mountName(i), "pid:", child.Process.Pid)
+		children = append(children, child)
+	}
+	exitChan := make(chan os.Signal, 1)
+	signal.Notify(exitChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range exitChan {
+			for _, c := range children {
+				c.Process.Signal(sig)
+			}
+		}
+	}()
+	code := 0
+	if len(children) < len(indexes) {
+		code = 1
+	}
+	for _, c := range children {
+		if err := c.Wait(); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]挂载进程退出：", c.Args[len(c.Args)-1], err)
+			code = 1
+		}
+	}
+	return code
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 把text写入临时的配置文件并读取
+func loadConfigText(t *testing.T, text string) (*config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "compressfs.toml")
+	if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig(path)
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := loadConfigText(t, `
+codec = "flate9"
+cache_size = "1G"
+
+[[mount]]
+name = "data"
+backend = "/srv/a"
+mountpoint = "/mnt/a"
+
+[[mount]]
+backend = "/srv/ab"
+mountpoint = "/mnt/b"
+read_only = true
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.mounts) != 2 || cfg.global["codec"] != "flate9" {
+		t.Fatalf("读到的配置不对：%+v", cfg)
+	}
+	if i, err := cfg.findMount("data"); err != nil || i != 0 {
+		t.Fatalf("findMount(data) = %d, %v", i, err)
+	}
+	if i, err := cfg.findMount("1"); err != nil || i != 1 {
+		t.Fatalf("findMount(1) = %d, %v", i, err)
+	}
+	if _, err := cfg.findMount("nope"); err == nil {
+		t.Fatal("找不到的挂载应该报错")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, tc := range []struct{ name, text, want string }{
+		{"语法错误", "codec = ", "读取配置文件失败"},
+		{"顶层的backend", "backend = \"/srv/a\"\n", "只能写在[[mount]]里"},
+		{"缺少mountpoint", "[[mount]]\nbackend = \"/srv/a\"\n", "缺少mountpoint"},
+		{"mount不是表", "mount = 1\n", "[[mount]]表"},
+		{"挂载目录重复", "[[mount]]\nbackend = \"/srv/a\"\nmountpoint = \"/mnt/a\"\n[[mount]]\nbackend = \"/srv/b\"\nmountpoint = \"/mnt/a/\"\n", "重复"},
+		{"backend重复", "[[mount]]\nbackend = \"/srv/a\"\nmountpoint = \"/mnt/a\"\n[[mount]]\nbackend = \"/srv/a/\"\nmountpoint = \"/mnt/b\"\n", "重复或者互相包含"},
+		{"backend互相包含", "[[mount]]\nbackend = \"/srv/a/b\"\nmountpoint = \"/mnt/a\"\n[[mount]]\nbackend = \"/srv/a\"\nmountpoint = \"/mnt/b\"\n", "重复或者互相包含"},
+	} {
+		_, err := loadConfigText(t, tc.text)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s：err = %v，应该包含%q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	fs, _ := mountFlagSet(findCommand("mount"))
+	if err := fs.Parse([]string{"-cache-size", "2G"}); err != nil {
+		t.Fatal(err)
+	}
+	set := map[string]bool{"cache-size": true}
+	err := applyConfig(fs, set, map[string]interface{}{"cache_size": "1G", "cache_ttl": "5m", "read-only": true, "backend": "/srv/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 命令行上的选项优先
+	if v := fs.Lookup("cache-size").Value.String(); v != "2G" {
+		t.Errorf("cache-size = %s，命令行上的选项应该优先", v)
+	}
+	if v := fs.Lookup("cache-ttl").Value.String(); v != "5m0s" {
+		t.Errorf("cache-ttl = %s", v)
+	}
+	if v := fs.Lookup("read-only").Value.String(); v != "true" {
+		t.Errorf("read-only = %s", v)
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		values map[string]interface{}
+		want   string
+	}{
+		{map[string]interface{}{"no_such_option": 1}, "未知的设置"},
+		{map[string]interface{}{"cache_ttl": "soon"}, "cache_ttl"},
+		{map[string]interface{}{"writeback_workers": "many"}, "writeback_workers"},
+		{map[string]interface{}{"allow_other": "maybe"}, "allow_other"},
+		{map[string]interface{}{"config": "other.toml"}, "不能设置"},
+		{map[string]interface{}{"mount_name": "data"}, "不能设置"},
+	} {
+		fs, _ := mountFlagSet(findCommand("mount"))
+		fs.SetOutput(io.Discard)
+		err := applyConfig(fs, map[string]bool{}, tc.values)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v：err = %v，应该包含%q", tc.values, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// 转换：把backend里的文件原地转换成另一种压缩方式。每个文件先转换到同一目录下的临时文件，再rename替换，
+// 文件头已经是目标压缩方式的文件跳过，所以中断后重新运行会接着转换剩下的文件
+type converter struct {
+	batch
+	backend string
+	codec   string
+	files   []string
+}
+
+// compressfs convert [选项] BACKEND
+func runConvert(cmd *command, args []string) int {
+	fs := cmd.flagSet()
+	to := fs.String("to", "", help("codec to convert to, e.g. zstd:9 or zstd:9,parity=10% (required)", "要转换成的压缩方式，例如zstd:9、zstd:9,parity=10%（必须指定）"))
+	checkLegacy := addLegacyCodecFlag(fs)
+	workers := fs.Int("workers", runtime.NumCPU(), help("number of files converted in parallel", "同时转换的文件数"))
+	quiet := fs.Bool("quiet", false, help("do not print progress", "不显示进度"))
+	if ok, code := cmd.parse(fs, args, 1, 1); !ok {
+		return code
+	}
+	if *to == "" {
+		fs.Usage()
+		return 2
+	}
+	codec, err := canonicalCodec(*to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "压缩参数错误！", err)
+		return 2
+	}
+	if err := checkLegacy(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *workers < 1 {
+		fmt.Fprintln(os.Stderr, "并发数参数错误！", *workers)
+		return 2
+	}
+	backend := filepath.Clean(fs.Arg(0))
+	if fi, err := os.Stat(backend); err != nil || !fi.IsDir() {
+		fmt.Fprintln(os.Stderr, "[ERROR]backend目录错误！", backend, err)
+		return 2
+	}
+	CompressType = codec
+
+	cv := &converter{
+		batch:   batch{tag: "convert", ratioLabel: "转换后为原来的", workers: *workers, quiet: *quiet},
+		backend: backend,
+		codec:   codec,
+	}
+	if err := filepath.WalkDir(backend, cv.scan); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		return 1
+	}
+	fmt.Printf("[convert]%d个文件，共%s，转换为%s，并发数%d\n", cv.totalFiles, formatSize(cv.totalBytes), codec, *workers)
+	if !cv.run(len(cv.files), func(i int) { cv.convert(cv.files[i]) }) {
+		fmt.Printf("[convert]已中断：处理了%d/%d个文件，重新运行同样的命令可以继续转换\n", cv.doneFiles.Load(), cv.totalFiles)
+		return 130
+	}
+	fmt.Printf("[convert]完成：%d个文件（不需要转换的%d个），%s -> %s，失败%d个\n",
+		cv.doneFiles.Load(), cv.skipped.Load(), formatSize(cv.bytesIn.Load()), formatSize(cv.bytesOut.Load()), cv.failed.Load())
+	if cv.failed.Load() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// 扫描backend，记录要转换的文件
+func (cv *converter) scan(path string, d fs.DirEntry, err error) error {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		cv.failed.Add(1)
+		return nil
+	}
+	if d.IsDir() && isMetaDir(cv.backend, path) {
+		return fs.SkipDir
+	}
+	if !d.Type().IsRegular() || isTempName(d.Name()) {
+		return nil
+	}
+	fi, err := d.Info()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		cv.failed.Add(1)
+		return nil
+	}
+	cv.files = append(cv.files, path)
+	cv.totalFiles++
+	cv.totalBytes += fi.Size()
+	return nil
+}
+
+// 转换一个文件
+func (cv *converter) convert(path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		cv.failed.Add(1)
+		return
+	}
+	need, err := needsConvert(path, cv.codec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", path, err)
+		cv.failed.Add(1)
+		return
+	}
+	cv.bytesIn.Add(fi.Size())
+	if !need {
+		cv.skipped.Add(1)
+		cv.bytesOut.Add(fi.Size())
+		return
+	}
+	tmpPath, err := convertToTemp(path, cv.codec, fi)
+	if err == nil {
+		if err = os.Rename(tmpPath, path); err != nil {
+			os.Remove(tmpPath)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]转换失败！", path, err)
+		cv.failed.Add(1)
+		cv.bytesOut.Add(fi.Size())
+		return
+	}
+	if fi, err := os.Stat(path); err == nil {
+		cv.bytesOut.Add(fi.Size())
+	}
+}
+
+// 判断压缩文件需不需要转换成codec（规范写法）。旧格式和没有校验和的文件总是需要转换
+func needsConvert(path, codec string) (bool, error) {
+	h, err := readFileHeader(path)
+	if err != nil {
+		return false, err
+	}
+	return h == nil || h.codec != codec || h.flags&flagChecksum == 0, nil
+}
+
+// 把压缩文件转换成codec，写到同一目录下的临时文件，返回临时文件的路径。临时文件的权限、所有者和修改时间
+// 都和原来的文件（fi）相同，解压后的内容也不变，所以rename替换后在挂载点里看不出区别
+func convertToTemp(path, codec string, fi os.FileInfo) (string, error) {
+	fc, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fc.Close()
+	var size int64
+	tmpPath, err := createTemp(filepath.Dir(path), fi, false, func(w io.Writer) (err error) {
+		size, err = transcodeFile(fc, w, codec)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	// 替换前把临时文件完整解压一遍，确认和原来的文件一样大
+	if err := verifyFile(tmpPath, size); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := os.Chtimes(tmpPath, time.Now(), fi.ModTime()); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
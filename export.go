@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 导出：不经过挂载，把backend里的压缩文件解压成普通文件，用于无法挂载（没有FUSE）的时候取出数据
+type exporter struct {
+	backend string
+	dest    string
+	verbose bool         // 显示每个导出的文件
+	dirs    []importFile // 要设置权限和修改时间的目录，父目录在前
+
+	files  int64
+	bytes  int64 // 解压后的大小
+	failed int64
+}
+
+// compressfs export [选项] BACKEND DEST [paths...]
+func runExport(cmd *command, args []string) int {
+	exp := &exporter{}
+	fs := cmd.flagSet()
+	checkLegacy := addLegacyCodecFlag(fs)
+	fs.BoolVar(&exp.verbose, "v", false, help("print every exported file", "显示每个导出的文件"))
+	if ok, code := cmd.parse(fs, args, 2, -1); !ok {
+		return code
+	}
+	if err := checkLegacy(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	exp.backend, exp.dest = filepath.Clean(fs.Arg(0)), filepath.Clean(fs.Arg(1))
+	if fi, err := os.Stat(exp.backend); err != nil || !fi.IsDir() {
+		fmt.Fprintln(os.Stderr, "[ERROR]backend目录错误！", exp.backend, err)
+		return 2
+	}
+	paths := fs.Args()[2:]
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	for i, p := range paths {
+		// 路径都是相对于backend的，不能跑到backend外面
+		rel := strings.TrimPrefix(filepath.Clean("/"+p), "/")
+		if rel == "" {
+			rel = "."
+		}
+		paths[i] = rel
+	}
+	if err := os.MkdirAll(exp.dest, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		return 1
+	}
+
+	for _, rel := range paths {
+		root := filepath.Join(exp.backend, rel)
+		if _, err := os.Lstat(root); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]", err)
+			exp.failed++
+			continue
+		}
+		// 选中的文件所在的目录
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(exp.dest, rel)), 0755); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]", err)
+			exp.failed++
+			continue
+		}
+		if err := filepath.WalkDir(root, exp.walk); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]", err)
+			exp.failed++
+		}
+	}
+	// 最后设置目录的属性，子目录在前
+	for i := len(exp.dirs) - 1; i >= 0; i-- {
+		d := exp.dirs[i]
+		if err := setMeta(d.dst, d.fi); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]设置目录属性失败！", err)
+			exp.failed++
+		}
+	}
+	fmt.Printf("[export]完成：%d个文件，共%s，失败%d个\n", exp.files, formatSize(exp.bytes), exp.failed)
+	if exp.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// 遍历backend时导出每个文件或目录，出错时记录下来继续导出其他文件
+func (exp *exporter) walk(path string, d fs.DirEntry, err error) error {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		exp.failed++
+		return nil
+	}
+	rel, err := filepath.Rel(exp.backend, path)
+	if err != nil {
+		return err
+	}
+	if err := exp.export(path, filepath.Join(exp.dest, rel), d); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]导出失败！", path, err)
+		exp.failed++
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+	} else if exp.verbose && !d.IsDir() {
+		fmt.Println(rel)
+	}
+	return nil
+}
+
+// 导出backend里的一个文件或目录
+func (exp *exporter) export(path, dst string, d fs.DirEntry) error {
+	if isTempName(d.Name()) {
+		return nil
+	}
+	if d.IsDir() && isMetaDir(exp.backend, path) {
+		return fs.SkipDir
+	}
+	fi, err := d.Info()
+	if err != nil {
+		return err
+	}
+	switch {
+	case d.IsDir():
+		// 导出的根目录（DEST本身）不修改属性
+		if dst == exp.dest {
+			return nil
+		}
+		if err := os.Mkdir(dst, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		exp.dirs = append(exp.dirs, importFile{path, dst, fi})
+	case isSpecialMode(fi.Mode()):
+		return makeSpecial(dst, fi)
+	case fi.Mode().IsRegular():
+		n, err := exportFile(path, dst, fi)
+		if err != nil {
+			return err
+		}
+		exp.files++
+		exp.bytes += n
+	default:
+		fmt.Fprintln(os.Stderr, "[WARN]不支持的文件类型，跳过：", path)
+	}
+	return nil
+}
+
+// 把一个压缩文件解压成普通文件：先解压到同一目录下的临时文件，设置好属性后再rename，
+// 这样解压失败不会留下不完整的文件。返回解压后的大小
+func exportFile(path, dst string, fi os.FileInfo) (int64, error) {
+	fc, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fc.Close()
+	fr, err := os.CreateTemp(filepath.Dir(dst), tempPattern)
+	if err != nil {
+		return 0, err
+	}
+	tmpPath := fr.Name()
+	// 写入*os.File时空洞不会写出来，导出的文件也是稀疏的
+	n, err := decodeFile(fc, fr)
+	if cerr := fr.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = setMeta(tmpPath, fi)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dst)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return n, nil
+}
+
+// compressfs cat [选项] BACKEND path
+func runCat(cmd *command, args []string) int {
+	fs := cmd.flagSet()
+	checkLegacy := addLegacyCodecFlag(fs)
+	if ok, code := cmd.parse(fs, args, 2, 2); !ok {
+		return code
+	}
+	if err := checkLegacy(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	path := filepath.Join(fs.Arg(0), filepath.Clean("/"+fs.Arg(1)))
+	fi, err := os.Stat(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		return 1
+	}
+	if !fi.Mode().IsRegular() {
+		fmt.Fprintln(os.Stderr, "[ERROR]不是普通文件：", fs.Arg(1))
+		return 1
+	}
+	fc, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		return 1
+	}
+	defer fc.Close()
+	// 不能直接传os.Stdout，decodeFile会把*os.File当作可以WriteAt的普通文件
+	w := bufio.NewWriterSize(os.Stdout, 1<<20)
+	_, err = decodeFile(fc, w)
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", fs.Arg(1), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 运行子命令，返回退出码
+func runCommand(name string, args ...string) int {
+	cmd := findCommand(name)
+	return cmd.run(cmd, args)
+}
+
+func TestImportExport(t *testing.T) {
+	src, backend, dest := t.TempDir(), t.TempDir(), filepath.Join(t.TempDir(), "out")
+	data := make([]byte, 300000)
+	rand.New(rand.NewSource(1)).Read(data)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// 稀疏文件：开头是数据，中间4M的空洞，最后又有数据
+	sparse, err := os.OpenFile(filepath.Join(src, "sparse"), os.O_WRONLY|os.O_CREATE, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sparse.Write(data)
+	sparse.WriteAt(data[:1000], int64(len(data))+4<<20)
+	sparse.Close()
+	if err := os.MkdirAll(filepath.Join(src, "dir"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"empty": nil, "dir/small": []byte("hello\n")}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(src, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"sparse", "empty", "dir/small"} {
+		os.Chtimes(filepath.Join(src, name), mtime, mtime)
+	}
+
+	if code := runCommand("import", "-quiet", "-codec", "flate1", src, backend); code != 0 {
+		t.Fatalf("import退出码%d", code)
+	}
+	if code := runCommand("export", backend, dest); code != 0 {
+		t.Fatalf("export退出码%d", code)
+	}
+
+	for _, name := range []string{"sparse", "empty", "dir/small"} {
+		want, _ := os.ReadFile(filepath.Join(src, name))
+		got, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s：导出的内容不一致", name)
+		}
+		wfi, _ := os.Stat(filepath.Join(src, name))
+		gfi, _ := os.Stat(filepath.Join(dest, name))
+		if gfi.Mode() != wfi.Mode() || !gfi.ModTime().Equal(mtime) {
+			t.Errorf("%s：权限%v、修改时间%v，应该是%v、%v", name, gfi.Mode(), gfi.ModTime(), wfi.Mode(), mtime)
+		}
+	}
+	// 空洞导出后仍然是空洞
+	fi, _ := os.Stat(filepath.Join(dest, "sparse"))
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Blocks*512 >= fi.Size() {
+		t.Errorf("sparse：导出后占用%d字节，空洞没有保留", st.Blocks*512)
+	}
+}
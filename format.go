@@ -0,0 +1,822 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// 压缩文件的格式（第1版）。文件按块压缩，全是0的区域记录成空洞，不占空间：
+//
+//	文件头：magic(8) 版本(1) flags(1) 块大小(4) 压缩方式名字的长度(1) 压缩方式的名字
+//	数据块：'D' 解压后的长度(4) 压缩后的长度(4) [校验和(4)] 压缩后的数据，每块单独压缩
+//	空洞：  'H' 长度(8)
+//	校验：  'P' ……，见parity.go，只有flags带flagParity时才有
+//	结束：  'E' 文件解压后的大小(8)，总是在文件最后，获取文件大小只需要读最后9个字节
+//
+// flags带flagChecksum时每个数据块有校验和：两个长度和压缩后数据的CRC32C，读取时校验，磁盘上的位翻转
+// 不会被当作正常数据解压出来。文件头里的压缩方式是完整的压缩设置（例如zstd:9,parity=10%）。
+// 整数都是小端序。开头没有magic的是旧格式：整个文件是一个压缩流，用CompressType解压。
+const (
+	formatMagic   = "\x89CFS\r\n\x1a\n"
+	formatVersion = 1
+	blockSize     = 1 << 20 // 数据块解压后的最大长度
+	pageSize      = 4096    // 检测空洞的粒度
+)
+
+// 文件头的flags
+const (
+	flagChecksum = 1 << 0 // 数据块带校验和
+	flagParity   = 1 << 1 // 记录按组保存，每组前面有纠错数据
+	knownFlags   = flagChecksum | flagParity
+)
+
+// 记录的类型
+const (
+	recordData = 'D'
+	recordHole = 'H'
+	recordEnd  = 'E'
+)
+
+// lseek的whence，syscall里没有定义
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// 压缩文件的内容不符合格式
+var errCorrupt = errors.New("压缩文件已损坏")
+
+// 压缩文件在结束记录之前就结束了（例如压缩到一半时崩溃）
+var errTruncated = errors.New("压缩文件被截断了")
+
+// 数据块无法解压。记录的边界是完整的，可以跳过这一块接着读后面的记录
+var errBadBlock = errors.New("数据块已损坏")
+
+// 数据块的校验和和保存的不一致。一般只是这一块的数据坏了，可以跳过这一块接着读后面的记录
+var errChecksum = errors.New("数据块校验和错误")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// 用来写空洞和判断全0的页
+var zeros = make([]byte, 64<<10)
+
+// 压缩文件头
+type formatHeader struct {
+	flags     uint8
+	blockSize uint32
+	codec     string
+}
+
+// 写入文件头
+func writeHeader(w io.Writer, h formatHeader) error {
+	buf := []byte(formatMagic)
+	buf = append(buf, formatVersion, h.flags)
+	buf = binary.LittleEndian.AppendUint32(buf, h.blockSize)
+	buf = append(buf, byte(len(h.codec)))
+	buf = append(buf, h.codec...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// 读取magic之后的文件头
+func readHeader(r io.Reader) (formatHeader, error) {
+	var h formatHeader
+	var buf [7]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return h, errCorrupt
+	}
+	if buf[0] != formatVersion {
+		return h, fmt.Errorf("不支持的压缩文件版本：%d", buf[0])
+	}
+	h.flags = buf[1]
+	h.blockSize = binary.LittleEndian.Uint32(buf[2:6])
+	codec := make([]byte, buf[6])
+	if _, err := io.ReadFull(r, codec); err != nil {
+		return h, errCorrupt
+	}
+	h.codec = string(codec)
+	if h.flags&^knownFlags != 0 {
+		return h, fmt.Errorf("不支持的压缩文件特性：%#x", h.flags)
+	}
+	if h.blockSize == 0 || h.blockSize > 64<<20 {
+		return h, errCorrupt
+	}
+	return h, nil
+}
+
+// 块格式的编码器：数据攒够一块再压缩写入，连续的空洞合并成一条记录
+type blockEncoder struct {
+	w      *bufio.Writer
+	out    io.Writer // 数据和空洞记录写到哪里：没有设置parity时是w，否则是group
+	codec  string    // 压缩方式（不带选项）
+	parity int
+	buf    []byte // 还没有压缩的数据
+	hole   int64  // 还没有写入的空洞长度
+	comp   bytes.Buffer
+	group  bytes.Buffer // 还没有写入的一组记录
+}
+
+// 创建编码器并写入文件头。spec是压缩设置，可以带parity
+func newBlockEncoder(w io.Writer, spec string) (*blockEncoder, error) {
+	spec, err := canonicalCodec(spec)
+	if err != nil {
+		return nil, err
+	}
+	codec, parity, _ := parseCodecSpec(spec)
+	e := &blockEncoder{w: bufio.NewWriter(w), codec: codec, parity: parity}
+	h := formatHeader{flags: flagChecksum, blockSize: blockSize, codec: spec}
+	e.out = e.w
+	if parity > 0 {
+		h.flags |= flagParity
+		e.out = &e.group
+	}
+	return e, writeHeader(e.w, h)
+}
+
+// 写入一段数据，全是0的页记录成空洞
+func (e *blockEncoder) write(p []byte) error {
+	for len(p) > 0 {
+		n := pageSize
+		if n > len(p) {
+			n = len(p)
+		}
+		zero := isZero(p[:n])
+		// 把连续的同类页合并
+		for n < len(p) {
+			m := n + pageSize
+			if m > len(p) {
+				m = len(p)
+			}
+			if isZero(p[n:m]) != zero {
+				break
+			}
+			n = m
+		}
+		var err error
+		if zero {
+			err = e.writeHole(int64(n))
+		} else {
+			err = e.writeData(p[:n])
+		}
+		if err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// 写入数据，攒够一块就压缩
+func (e *blockEncoder) writeData(p []byte) error {
+	if err := e.flushHole(); err != nil {
+		return err
+	}
+	for len(p) > 0 {
+		n := blockSize - len(e.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+		if len(e.buf) == blockSize {
+			if err := e.flushData(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 写入n字节的空洞
+func (e *blockEncoder) writeHole(n int64) error {
+	if err := e.flushData(); err != nil {
+		return err
+	}
+	e.hole += n
+	return nil
+}
+
+// 压缩并写入攒下的数据
+func (e *blockEncoder) flushData() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+	e.comp.Reset()
+	cw, err := newCodecWriter(e.codec, &e.comp)
+	if err != nil {
+		return err
+	}
+	if _, err := cw.Write(e.buf); err != nil {
+		cw.Close()
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	var hdr [13]byte
+	hdr[0] = recordData
+	binary.LittleEndian.PutUint32(hdr[1:], uint32(len(e.buf)))
+	binary.LittleEndian.PutUint32(hdr[5:], uint32(e.comp.Len()))
+	binary.LittleEndian.PutUint32(hdr[9:], blockChecksum(hdr[1:9], e.comp.Bytes()))
+	e.out.Write(hdr[:])
+	if _, err := e.out.Write(e.comp.Bytes()); err != nil {
+		return err
+	}
+	e.buf = e.buf[:0]
+	return e.checkGroup()
+}
+
+// 数据块的校验和：两个长度和压缩后的数据的CRC32C
+func blockChecksum(lengths, comp []byte) uint32 {
+	return crc32.Update(crc32.Checksum(lengths, crcTable), crcTable, comp)
+}
+
+// 写入攒下的空洞
+func (e *blockEncoder) flushHole() error {
+	if e.hole == 0 {
+		return nil
+	}
+	err := writeRecord(e.out, recordHole, e.hole)
+	e.hole = 0
+	if err != nil {
+		return err
+	}
+	return e.checkGroup()
+}
+
+// 攒够一组记录就算出纠错数据，和这组记录一起写入
+func (e *blockEncoder) checkGroup() error {
+	if e.parity == 0 || e.group.Len() < parityGroupSize {
+		return nil
+	}
+	return e.flushGroup()
+}
+
+// 写入攒下的一组记录
+func (e *blockEncoder) flushGroup() error {
+	if e.group.Len() == 0 {
+		return nil
+	}
+	err := writeParityGroup(e.w, e.group.Bytes(), e.parity)
+	e.group.Reset()
+	return err
+}
+
+// 写完剩下的数据和结束记录
+func (e *blockEncoder) close(size int64) error {
+	if err := e.flushData(); err != nil {
+		return err
+	}
+	if err := e.flushHole(); err != nil {
+		return err
+	}
+	// 设置了parity时结束记录也放在最后一组里，受纠错数据保护
+	if e.parity > 0 {
+		if err := writeRecord(e.out, recordEnd, size); err != nil {
+			return err
+		}
+		if err := e.flushGroup(); err != nil {
+			return err
+		}
+	}
+	// 文件最后总是结束记录，获取文件大小时只读最后9个字节
+	if err := writeRecord(e.w, recordEnd, size); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+// 写入一条带8字节参数的记录（空洞、结束）
+func writeRecord(w io.Writer, kind byte, n int64) error {
+	var buf [9]byte
+	buf[0] = kind
+	binary.LittleEndian.PutUint64(buf[1:], uint64(n))
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// 把解压后的数据（大小为size）压缩成块格式写入w。raw是*os.File的话，
+// 用SEEK_DATA/SEEK_HOLE直接跳过稀疏文件的空洞，不用读一遍
+func encodeFile(w io.Writer, raw io.ReaderAt, size int64, codec string) error {
+	e, err := newBlockEncoder(w, codec)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, blockSize)
+	for off := int64(0); off < size; {
+		start, end := off, size
+		if f, ok := raw.(*os.File); ok {
+			start, end = dataRegion(f, off, size)
+		}
+		if start > off {
+			if err := e.writeHole(start - off); err != nil {
+				return err
+			}
+		}
+		for off = start; off < end; {
+			n := end - off
+			if n > blockSize {
+				n = blockSize
+			}
+			if m, err := raw.ReadAt(buf[:n], off); int64(m) < n {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			if err := e.write(buf[:n]); err != nil {
+				return err
+			}
+			off += n
+		}
+	}
+	return e.close(size)
+}
+
+// 返回off之后的第一段数据[start, end)。文件系统不支持SEEK_DATA的话，整个文件都当作数据
+func dataRegion(f *os.File, off, size int64) (int64, int64) {
+	start, err := f.Seek(off, seekData)
+	if err != nil {
+		if errors.Is(err, syscall.ENXIO) {
+			// 后面全是空洞
+			return size, size
+		}
+		return off, size
+	}
+	if start > size {
+		return size, size
+	}
+	end, err := f.Seek(start, seekHole)
+	if err != nil || end > size {
+		end = size
+	}
+	return start, end
+}
+
+// 判断是不是全是0
+func isZero(p []byte) bool {
+	for len(p) > 0 {
+		n := len(p)
+		if n > len(zeros) {
+			n = len(zeros)
+		}
+		if !bytes.Equal(p[:n], zeros[:n]) {
+			return false
+		}
+		p = p[n:]
+	}
+	return true
+}
+
+// 块格式的读取器，按顺序返回每条记录
+type blockReader struct {
+	r    *bufio.Reader
+	h    formatHeader
+	pr   *parityReader // 设置了parity时，记录从这里读，读到的是校验（修复）过的数据
+	off  int64         // 下一条记录在解压后文件里的位置
+	comp []byte
+	data []byte
+}
+
+// 一条记录
+type record struct {
+	kind   byte
+	off    int64  // 在解压后文件里的位置
+	length int64  // 数据块或者空洞的长度；结束记录为文件解压后的大小
+	data   []byte // 数据块解压后的数据，下次调用next之前有效
+}
+
+// 读取文件头，返回块格式的读取器。旧格式的文件返回nil
+func newBlockReader(r *bufio.Reader) (*blockReader, error) {
+	magic, _ := r.Peek(len(formatMagic))
+	if string(magic) != formatMagic {
+		return nil, nil
+	}
+	r.Discard(len(formatMagic))
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	// 尽早发现不支持的压缩方式
+	if !validCodec(h.codec) {
+		return nil, fmt.Errorf("未知的压缩方式：%q", h.codec)
+	}
+	br := &blockReader{r: r, h: h}
+	if h.flags&flagParity != 0 {
+		br.pr = &parityReader{r: r, off: int64(len(formatMagic) + 7 + len(h.codec))}
+		br.r = bufio.NewReader(br.pr)
+	}
+	return br, nil
+}
+
+// 读取下一条记录。文件没有结束记录就结束了返回errTruncated，数据块校验和不对返回errChecksum、无法解压返回errBadBlock
+// （rec.length是这一块的长度），其他不符合格式的情况返回errCorrupt
+func (br *blockReader) next() (record, error) {
+	rec := record{off: br.off}
+	kind, err := br.r.ReadByte()
+	if err != nil {
+		return rec, readError(err)
+	}
+	rec.kind = kind
+	switch kind {
+	case recordData:
+		var hdr [12]byte
+		hdrLen := 8
+		if br.h.flags&flagChecksum != 0 {
+			hdrLen = 12
+		}
+		if _, err := io.ReadFull(br.r, hdr[:hdrLen]); err != nil {
+			return rec, readError(err)
+		}
+		rawLen := binary.LittleEndian.Uint32(hdr[0:])
+		compLen := binary.LittleEndian.Uint32(hdr[4:])
+		if rawLen == 0 || rawLen > br.h.blockSize || compLen > 2*br.h.blockSize+4096 {
+			return rec, errCorrupt
+		}
+		if cap(br.comp) < int(compLen) {
+			br.comp = make([]byte, compLen)
+		}
+		br.comp = br.comp[:compLen]
+		if _, err := io.ReadFull(br.r, br.comp); err != nil {
+			return rec, readError(err)
+		}
+		if cap(br.data) < int(rawLen) {
+			br.data = make([]byte, rawLen)
+		}
+		br.data = br.data[:rawLen]
+		rec.length = int64(rawLen)
+		if hdrLen == 12 && blockChecksum(hdr[:8], br.comp) != binary.LittleEndian.Uint32(hdr[8:]) {
+			br.off += rec.length
+			return rec, errChecksum
+		}
+		cr, err := newCodecReader(br.h.codec, bytes.NewReader(br.comp))
+		if err == nil {
+			_, err = io.ReadFull(cr, br.data)
+			cr.Close()
+		}
+		if err != nil {
+			br.off += rec.length
+			return rec, errBadBlock
+		}
+		rec.data = br.data
+	case recordHole, recordEnd:
+		var buf [8]byte
+		if _, err := io.ReadFull(br.r, buf[:]); err != nil {
+			return rec, readError(err)
+		}
+		rec.length = int64(binary.LittleEndian.Uint64(buf[:]))
+		if rec.length < 0 || (kind == recordEnd && rec.length != br.off) {
+			return rec, errCorrupt
+		}
+		if kind == recordEnd && br.pr != nil {
+			br.checkTail(rec.length)
+		}
+	default:
+		return rec, errCorrupt
+	}
+	if kind != recordEnd {
+		br.off += rec.length
+	}
+	return rec, nil
+}
+
+// 读取记录时遇到文件结束说明文件被截断了，其他错误（磁盘读取错误）原样返回
+func readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errTruncated
+	}
+	return err
+}
+
+// 解压压缩文件r并写入w，返回解压后的大小。w是*os.File的话（必须是新建的空文件）空洞直接跳过，
+// 解压后的文件也是稀疏的，否则空洞写入0。旧格式的文件用CompressType解压
+func decodeFile(r io.Reader, w io.Writer) (int64, error) {
+	n, _, err := decodeFileFixes(r, w)
+	return n, err
+}
+
+// 同 decodeFile ，另外返回用纠错数据修复好的部分，写回压缩文件就修好了磁盘上的文件
+func decodeFileFixes(r io.Reader, w io.Writer) (int64, []parityFix, error) {
+	buffered := bufio.NewReader(r)
+	br, err := newBlockReader(buffered)
+	if err != nil {
+		return 0, nil, err
+	}
+	// 旧格式
+	if br == nil {
+		cr, err := NewReader(buffered)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer cr.Close()
+		n, err := io.Copy(w, cr)
+		return n, nil, err
+	}
+	n, err := br.decode(w)
+	if br.pr != nil {
+		return n, br.pr.fixes, err
+	}
+	return n, nil, err
+}
+
+// 设置了parity时，读到最后一组里的结束记录后检查文件最后的那一份，坏了（或者被截断了）的话记下修复
+func (br *blockReader) checkTail(size int64) {
+	var want [9]byte
+	want[0] = recordEnd
+	binary.LittleEndian.PutUint64(want[1:], uint64(size))
+	var got [10]byte
+	n, _ := io.ReadFull(br.r, got[:])
+	if br.pr.tail && n < len(got) && !bytes.Equal(got[:n], want[:]) {
+		br.pr.fixes = append(br.pr.fixes, parityFix{off: br.pr.tailOff, data: want[:]})
+	}
+}
+
+// 解压所有记录并写入w，出错时返回出错的位置
+func (br *blockReader) decode(w io.Writer) (int64, error) {
+	file, sparse := w.(*os.File)
+	for {
+		rec, err := br.next()
+		if err != nil {
+			return rec.off, err
+		}
+		switch rec.kind {
+		case recordData:
+			if sparse {
+				_, err = file.WriteAt(rec.data, rec.off)
+			} else {
+				_, err = w.Write(rec.data)
+			}
+		case recordHole:
+			if !sparse {
+				err = writeZeros(w, rec.length)
+			}
+		case recordEnd:
+			if sparse {
+				err = file.Truncate(rec.length)
+			}
+			return rec.length, err
+		}
+		if err != nil {
+			return rec.off, err
+		}
+	}
+}
+
+// 返回压缩文件解压后的大小。块格式只需要读最后的结束记录，旧格式需要解压一遍
+func decodedSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	head := make([]byte, len(formatMagic))
+	n, _ := io.ReadFull(f, head)
+	if string(head[:n]) != formatMagic {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return decodeFile(f, io.Discard)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var tail [9]byte
+	if fi.Size() < int64(len(formatMagic)+len(tail)) {
+		return 0, errTruncated
+	}
+	if _, err := f.ReadAt(tail[:], fi.Size()-int64(len(tail))); err != nil {
+		return 0, err
+	}
+	if tail[0] != recordEnd {
+		return 0, errTruncated
+	}
+	return int64(binary.LittleEndian.Uint64(tail[1:])), nil
+}
+
+// 写入n字节的0
+func writeZeros(w io.Writer, n int64) error {
+	for n > 0 {
+		m := int64(len(zeros))
+		if m > n {
+			m = n
+		}
+		if _, err := w.Write(zeros[:m]); err != nil {
+			return err
+		}
+		n -= m
+	}
+	return nil
+}
+
+// 从off开始写入n字节的0
+func writeZerosAt(f *os.File, off, n int64) error {
+	for n > 0 {
+		m := int64(len(zeros))
+		if m > n {
+			m = n
+		}
+		if _, err := f.WriteAt(zeros[:m], off); err != nil {
+			return err
+		}
+		off += m
+		n -= m
+	}
+	return nil
+}
+
+// 读取压缩文件的文件头，旧格式的文件返回nil
+func readFileHeader(path string) (*formatHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br, err := newBlockReader(bufio.NewReader(f))
+	if err != nil || br == nil {
+		return nil, err
+	}
+	return &br.h, nil
+}
+
+// 把解压后的数据压缩写入path：先写到同一目录下的临时文件，再rename替换原来的文件，
+// 这样压缩失败也不会破坏原来的文件。meta不为nil时按它设置权限和所有者，durable为true时保证数据已经落盘
+func writeCompressed(path string, raw io.ReaderAt, size int64, codec string, meta os.FileInfo, durable bool) error {
+	dir := filepath.Dir(path)
+	tmpPath, err := createTemp(dir, meta, durable, func(w io.Writer) error {
+		return encodeFile(w, raw, size, codec)
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if durable {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+// 在dir里创建一个临时文件，由write写入内容，返回临时文件的路径。meta不为nil时按它设置权限和所有者，
+// durable为true时保证数据已经落盘。失败时删除临时文件
+func createTemp(dir string, meta os.FileInfo, durable bool, write func(w io.Writer) error) (string, error) {
+	f, err := os.CreateTemp(dir, tempPattern)
+	if err != nil {
+		return "", err
+	}
+	tmpPath := f.Name()
+	if meta != nil {
+		// 先chown再chmod，chown会清掉setuid位
+		if st, ok := meta.Sys().(*syscall.Stat_t); ok {
+			f.Chown(int(st.Uid), int(st.Gid))
+		}
+		f.Chmod(meta.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky))
+	}
+	err = write(f)
+	if err == nil && durable {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// 把压缩文件r转换成另一种压缩方式写入w，不用先解压到临时文件，空洞保持不变，返回解压后的大小。
+// 旧格式的文件只有明确指定了 LegacyCodec 才转换
+func transcodeFile(r io.Reader, w io.Writer, codec string) (int64, error) {
+	buffered := bufio.NewReader(r)
+	br, err := newBlockReader(buffered)
+	if err != nil {
+		return 0, err
+	}
+	var cr io.ReadCloser
+	if br == nil {
+		if cr, err = explicitLegacyReader(buffered); err != nil {
+			return 0, err
+		}
+		defer cr.Close()
+	}
+	e, err := newBlockEncoder(w, codec)
+	if err != nil {
+		return 0, err
+	}
+	// 旧格式：解压后按顺序写入，全是0的页变成空洞。解压到结尾才算完整（截断的流返回 io.ErrUnexpectedEOF）
+	if br == nil {
+		ew := &encoderWriter{e: e}
+		if _, err := io.CopyBuffer(ew, cr, make([]byte, blockSize)); err != nil {
+			return 0, err
+		}
+		return ew.n, e.close(ew.n)
+	}
+	for {
+		rec, err := br.next()
+		if err != nil {
+			return 0, err
+		}
+		switch rec.kind {
+		case recordData:
+			err = e.writeData(rec.data)
+		case recordHole:
+			err = e.writeHole(rec.length)
+		case recordEnd:
+			return rec.length, e.close(rec.length)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// 完整解压一遍压缩文件path，检查解压后是size字节。转换、修复后替换原来的文件之前调用
+func verifyFile(path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := decodeFile(f, io.Discard)
+	if err != nil {
+		return fmt.Errorf("校验写出的文件失败：%v", err)
+	}
+	if n != size {
+		return fmt.Errorf("校验写出的文件失败：解压后%d字节，应该是%d字节", n, size)
+	}
+	return nil
+}
+
+// 把编码器包装成io.Writer，记录写入的长度
+type encoderWriter struct {
+	e *blockEncoder
+	n int64
+}
+
+func (w *encoderWriter) Write(p []byte) (int, error) {
+	if err := w.e.write(p); err != nil {
+		return 0, err
+	}
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// 尽量恢复损坏的压缩文件r，写入w（块格式）：无法解压的数据块换成空洞（读出来是0），
+// 文件被截断或者记录损坏时只保留前面完整的部分。返回恢复后的大小和丢失的字节数（不包括截断的部分）
+func salvageFile(r io.Reader, w io.Writer) (size, lost int64, err error) {
+	buffered := bufio.NewReader(r)
+	br, err := newBlockReader(buffered)
+	if err != nil {
+		return 0, 0, err
+	}
+	// 旧格式：保留能解压出来的部分。只有明确指定了 LegacyCodec 才修复
+	if br == nil {
+		cr, err := explicitLegacyReader(buffered)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer cr.Close()
+		e, err := newBlockEncoder(w, LegacyCodec)
+		if err != nil {
+			return 0, 0, err
+		}
+		ew := &encoderWriter{e: e}
+		io.CopyBuffer(ew, cr, make([]byte, blockSize))
+		return ew.n, 0, e.close(ew.n)
+	}
+	e, err := newBlockEncoder(w, br.h.codec)
+	if err != nil {
+		return 0, 0, err
+	}
+	for {
+		rec, err := br.next()
+		switch {
+		case err == errBadBlock, err == errChecksum:
+			lost += rec.length
+			err = e.writeHole(rec.length)
+		case err != nil:
+			return br.off, lost, e.close(br.off)
+		case rec.kind == recordData:
+			err = e.writeData(rec.data)
+		case rec.kind == recordHole:
+			err = e.writeHole(rec.length)
+		case rec.kind == recordEnd:
+			return rec.length, lost, e.close(rec.length)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+}
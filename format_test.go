@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 测试数据：不好压缩的随机数据，中间和末尾各有一段全是0的区域（压缩时记录成空洞）
+func testData(t *testing.T) []byte {
+	t.Helper()
+	data := make([]byte, 3*blockSize+12345)
+	rand.New(rand.NewSource(1)).Read(data)
+	copy(data[blockSize/2:], make([]byte, blockSize))
+	copy(data[len(data)-3*pageSize:], make([]byte, 3*pageSize))
+	return data
+}
+
+// 把data压缩成块格式
+func encodeBytes(t *testing.T, data []byte, codec string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encodeFile(&buf, bytes.NewReader(data), int64(len(data)), codec); err != nil {
+		t.Fatalf("encodeFile(%s): %v", codec, err)
+	}
+	return buf.Bytes()
+}
+
+func TestEncodeDecode(t *testing.T) {
+	data := testData(t)
+	for _, codec := range []string{"lzw", "flate1", "flate9", "flate:3", "gzip", "zlib", "zstd", "zstd:9", "zstd:9,parity=10%"} {
+		enc := encodeBytes(t, data, codec)
+		// 空洞不占空间
+		if codec == "flate1" && len(enc) > len(data)-blockSize+64<<10 {
+			t.Errorf("%s: 压缩后%d字节，空洞没有跳过", codec, len(enc))
+		}
+		var out bytes.Buffer
+		n, err := decodeFile(bytes.NewReader(enc), &out)
+		if err != nil {
+			t.Fatalf("%s: decodeFile: %v", codec, err)
+		}
+		if n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("%s: 解压后的数据不一致（%d字节）", codec, n)
+		}
+	}
+}
+
+func TestDecodeSparseFile(t *testing.T) {
+	data := testData(t)
+	enc := encodeBytes(t, data, "flate1")
+	f, err := os.Create(filepath.Join(t.TempDir(), "raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := decodeFile(bytes.NewReader(enc), f); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("解压到文件后的数据不一致")
+	}
+}
+
+func TestEncodeEmpty(t *testing.T) {
+	enc := encodeBytes(t, nil, "flate1")
+	var out bytes.Buffer
+	if n, err := decodeFile(bytes.NewReader(enc), &out); err != nil || n != 0 {
+		t.Fatalf("decodeFile = %d, %v", n, err)
+	}
+}
+
+func TestDecodedSize(t *testing.T) {
+	data := testData(t)
+	path := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(path, encodeBytes(t, data, "flate1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := decodedSize(path); err != nil || n != int64(len(data)) {
+		t.Fatalf("decodedSize = %d, %v, want %d", n, err, len(data))
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	enc := encodeBytes(t, testData(t), "flate1")
+	if _, err := decodeFile(bytes.NewReader(enc[:len(enc)/2]), &bytes.Buffer{}); err == nil {
+		t.Fatal("被截断的文件应该报错")
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	data := testData(t)
+	enc := encodeBytes(t, data, "zstd")
+	// 文件中间是后面某一块的压缩数据，只翻转一位
+	enc[len(enc)/2] ^= 0x10
+	n, err := decodeFile(bytes.NewReader(enc), &bytes.Buffer{})
+	if !errors.Is(err, errChecksum) {
+		t.Fatalf("decodeFile err = %v, want errChecksum", err)
+	}
+	if n <= 0 || n%pageSize != 0 {
+		t.Fatalf("出错的位置 = %d，应该是后面某一块的开头", n)
+	}
+}
+
+func TestUnknownFlags(t *testing.T) {
+	enc := encodeBytes(t, []byte("hello"), "zstd")
+	enc[len(formatMagic)+1] |= 0x80
+	if _, err := decodeFile(bytes.NewReader(enc), &bytes.Buffer{}); err == nil {
+		t.Fatal("不认识的flags应该报错")
+	}
+}
+
+// 破坏第一个数据块的压缩数据（zstd的magic），让它无法解压
+func breakFirstBlock(enc []byte) {
+	hdr := len(formatMagic) + 7 + len("zstd") // 文件头
+	enc[hdr+13] ^= 0xff                       // 'D' 解压后的长度(4) 压缩后的长度(4) CRC32C(4)
+}
+
+func TestSalvageBadBlock(t *testing.T) {
+	data := testData(t)
+	enc := encodeBytes(t, data, "zstd")
+	breakFirstBlock(enc)
+	if _, err := decodeFile(bytes.NewReader(enc), &bytes.Buffer{}); !errors.Is(err, errChecksum) {
+		t.Fatalf("decodeFile err = %v, want errChecksum", err)
+	}
+	var fixed bytes.Buffer
+	size, lost, err := salvageFile(bytes.NewReader(enc), &fixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 第一块是开头的blockSize/2字节（后面是空洞）
+	if size != int64(len(data)) || lost != blockSize/2 {
+		t.Fatalf("salvageFile = %d, %d", size, lost)
+	}
+	// 坏的块变成0，其他的数据不变
+	var out bytes.Buffer
+	if _, err := decodeFile(bytes.NewReader(fixed.Bytes()), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := append(make([]byte, lost), data[lost:]...)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatal("恢复后的数据不对")
+	}
+}
+
+func TestSalvageTruncated(t *testing.T) {
+	data := testData(t)
+	enc := encodeBytes(t, data, "zstd")
+	enc = enc[:len(enc)*3/4]
+	var fixed bytes.Buffer
+	size, lost, err := salvageFile(bytes.NewReader(enc), &fixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size <= 0 || size >= int64(len(data)) || lost != 0 {
+		t.Fatalf("salvageFile = %d, %d", size, lost)
+	}
+	var out bytes.Buffer
+	if _, err := decodeFile(bytes.NewReader(fixed.Bytes()), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data[:size]) {
+		t.Fatal("截断的文件应该保留前面完整的部分")
+	}
+}
+
+// 旧版本写的压缩文件：整个文件一个压缩流，没有文件头
+func encodeLegacy(t *testing.T, data []byte, codec string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	cw, err := newCodecWriter(codec, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTranscodeLegacy(t *testing.T) {
+	data := testData(t)
+	enc := encodeLegacy(t, data, "lzw")
+	defer func(codec, legacy string) { CompressType, LegacyCodec = codec, legacy }(CompressType, LegacyCodec)
+	// 没有明确指定旧格式的压缩方式时不转换、不修复，即使设置了CompressType
+	CompressType, LegacyCodec = "lzw", ""
+	if _, err := transcodeFile(bytes.NewReader(enc), &bytes.Buffer{}, "zstd"); !errors.Is(err, errLegacyCodec) {
+		t.Fatalf("transcodeFile err = %v, want errLegacyCodec", err)
+	}
+	if _, _, err := salvageFile(bytes.NewReader(enc), &bytes.Buffer{}); !errors.Is(err, errLegacyCodec) {
+		t.Fatalf("salvageFile err = %v, want errLegacyCodec", err)
+	}
+	LegacyCodec = "lzw"
+	var conv bytes.Buffer
+	n, err := transcodeFile(bytes.NewReader(enc), &conv, "zstd")
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("transcodeFile = %d, %v", n, err)
+	}
+	var out bytes.Buffer
+	if _, err := decodeFile(bytes.NewReader(conv.Bytes()), &out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("转换后的数据不一致：%v", err)
+	}
+	// 被截断的旧格式文件不能当作完整的文件转换
+	if _, err := transcodeFile(bytes.NewReader(enc[:len(enc)/2]), &bytes.Buffer{}, "zstd"); err == nil {
+		t.Fatal("截断的旧格式文件应该转换失败")
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	data := testData(t)
+	path := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(path, encodeBytes(t, data, "zstd"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyFile(path, int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyFile(path, int64(len(data))+1); err == nil {
+		t.Fatal("大小不一致应该报错")
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fsck的退出码，和e2fsck相同，可以按位组合
+const (
+	fsckOK          = 0  // 没有问题
+	fsckCorrected   = 1  // 发现的问题都已经处理（隔离或者修复）
+	fsckUncorrected = 4  // 有问题没有处理
+	fsckError       = 8  // 运行出错，例如backend无法读取、隔离或者修复失败
+	fsckUsage       = 16 // 参数错误
+)
+
+// 问题的种类
+const (
+	problemCorrupt    = "corrupt"     // 压缩数据损坏，无法解压
+	problemTruncated  = "truncated"   // 压缩文件被截断了（没有结束记录）
+	problemUnreadable = "unreadable"  // 读取压缩文件时出错（磁盘错误、没有权限）
+	problemOrphanRaw  = "orphan-raw"  // 旧版本异常退出时留在backend里的解压文件（*.compressfs.raw）
+	problemOrphanTemp = "orphan-temp" // 压缩到一半时异常退出留下的临时文件
+	problemRepairable = "repairable"  // 坏了一点，可以用纠错数据修复（读取时会自动修复）
+	problemLegacy     = "legacy"      // 没有文件头的旧格式文件，没有指定-legacy-codec，无法检查
+)
+
+// fsck发现的一个问题
+type fsckProblem struct {
+	Path   string `json:"path"` // 相对于backend的路径
+	Kind   string `json:"kind"`
+	Error  string `json:"error,omitempty"`
+	Offset int64  `json:"offset"`           // 出错的位置（解压后的偏移），不知道时为-1
+	Action string `json:"action,omitempty"` // 处理的结果：quarantined、repaired、removed、recovered，没有处理时为空
+	Detail string `json:"detail,omitempty"` // 处理的说明，例如修复后丢失了多少数据
+}
+
+// fsck的结果
+type fsckReport struct {
+	Backend    string        `json:"backend"`
+	Files      int64         `json:"files"`                // 检查过的压缩文件数
+	Bytes      int64         `json:"logical_bytes"`        // 检查过的文件解压后的大小
+	Quarantine string        `json:"quarantine,omitempty"` // 本次使用的隔离目录，没有隔离文件时为空
+	Problems   []fsckProblem `json:"problems"`
+	Errors     []string      `json:"errors,omitempty"` // 运行时的错误
+	ExitCode   int           `json:"exit_code"`
+}
+
+type fsck struct {
+	batch
+	backend    string
+	quarantine string // 隔离目录，为空表示不隔离
+	repair     bool
+	files      []string
+
+	mu     sync.Mutex
+	report fsckReport
+}
+
+// compressfs fsck [选项] BACKEND
+func runFsck(cmd *command, args []string) int {
+	fs := cmd.flagSet()
+	checkLegacy := addLegacyCodecFlag(fs)
+	quarantine := fs.Bool("quarantine", false, help("move damaged files and leftovers to BACKEND/.compressfs/quarantine", "把损坏的文件和残留的文件移到BACKEND/.compressfs/quarantine"))
+	repair := fs.Bool("repair", false, help("repair damage from parity data, salvage other damaged files in place (unreadable blocks become zeros, the original is kept in the quarantine), remove leftover temp files and recover leftover .compressfs.raw files", "用纠错数据修复损坏的部分，其他损坏的文件原地修复（无法解压的块变成0，原来的文件保存在隔离目录里），删除残留的临时文件，恢复残留的.compressfs.raw文件"))
+	asJSON := fs.Bool("json", false, help("print the report as JSON", "以JSON格式输出结果"))
+	workers := fs.Int("workers", runtime.NumCPU(), help("number of files checked in parallel", "同时检查的文件数"))
+	quiet := fs.Bool("quiet", false, help("do not print progress", "不显示进度"))
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", os.Args[0], cmd.name, cmd.args)
+		fmt.Fprintf(os.Stderr, "  %s\n  %s\n", cmd.summary, cmd.summaryZh)
+		fmt.Fprintf(os.Stderr, "  Run it on an unmounted backend. 请在没有挂载的时候运行。\n")
+		fmt.Fprintf(os.Stderr, "  Exit status / 退出码: 0 no problems / 没有问题, 1 problems corrected / 问题都已处理, 4 problems left / 有问题没有处理, 8 operational error / 运行出错, 16 usage error / 参数错误\n")
+		fmt.Fprintf(os.Stderr, "Options / 选项：\n")
+		fs.PrintDefaults()
+	}
+	if ok, code := cmd.parse(fs, args, 1, 1); !ok {
+		if code != 0 {
+			return fsckUsage
+		}
+		return 0
+	}
+	if err := checkLegacy(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return fsckUsage
+	}
+	if *workers < 1 {
+		fmt.Fprintln(os.Stderr, "并发数参数错误！", *workers)
+		return fsckUsage
+	}
+	// 恢复.compressfs.raw文件时用旧版本的压缩方式写回。没有指定-legacy-codec时分不出残留的解压文件，不会恢复
+	CompressType = LegacyCodec
+
+	fk := &fsck{
+		batch:   batch{tag: "fsck", workers: *workers, quiet: *quiet || *asJSON},
+		backend: filepath.Clean(fs.Arg(0)),
+		repair:  *repair,
+	}
+	fk.report.Backend = fk.backend
+	fk.report.Problems = []fsckProblem{}
+	if fi, err := os.Stat(fk.backend); err != nil || !fi.IsDir() {
+		fmt.Fprintln(os.Stderr, "[ERROR]backend目录错误！", fk.backend, err)
+		return fsckError
+	}
+	// 修复会改写文件，原来的文件总是保存在隔离目录里。目录名后面加上随机的后缀，同一秒里运行多次也不会混在一起
+	if *quarantine || *repair {
+		dir := filepath.Join(fk.backend, metaDirName, "quarantine")
+		err := os.MkdirAll(dir, 0700)
+		if err == nil {
+			dir, err = os.MkdirTemp(dir, time.Now().Format("20060102-150405")+"-*")
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]创建隔离目录失败！", err)
+			return fsckError
+		}
+		fk.quarantine = dir
+	}
+
+	if err := filepath.WalkDir(fk.backend, fk.scan); err != nil {
+		fk.addError(err)
+	}
+	if !fk.run(len(fk.files), func(i int) { fk.check(fk.files[i]) }) {
+		fmt.Fprintln(os.Stderr, "[fsck]已中断")
+		fk.addError(errors.New("interrupted"))
+	}
+	// 没有用到的隔离目录删掉（只能删除空目录）
+	if fk.quarantine != "" && os.Remove(fk.quarantine) != nil {
+		fk.report.Quarantine = fk.quarantine
+	}
+
+	r := &fk.report
+	sort.Slice(r.Problems, func(i, j int) bool { return r.Problems[i].Path < r.Problems[j].Path })
+	for _, p := range r.Problems {
+		if p.Action == "" {
+			r.ExitCode |= fsckUncorrected
+		} else {
+			r.ExitCode |= fsckCorrected
+		}
+	}
+	if len(r.Errors) > 0 {
+		r.ExitCode |= fsckError
+	}
+	if *asJSON {
+		out, _ := json.MarshalIndent(r, "", "  ")
+		fmt.Println(string(out))
+		return r.ExitCode
+	}
+	for _, p := range r.Problems {
+		line := fmt.Sprintf("%-11s %s", p.Kind, p.Path)
+		if p.Error != "" {
+			line += "：" + p.Error
+		}
+		if p.Offset >= 0 {
+			line += fmt.Sprintf("（偏移%d）", p.Offset)
+		}
+		if p.Action != "" {
+			line += " -> " + p.Action
+		}
+		if p.Detail != "" {
+			line += "，" + p.Detail
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("[fsck]检查了%d个文件，共%s，发现%d个问题", r.Files, formatSize(r.Bytes), len(r.Problems))
+	if r.Quarantine != "" {
+		fmt.Printf("，隔离目录：%s", r.Quarantine)
+	}
+	fmt.Println()
+	return r.ExitCode
+}
+
+// 扫描backend：记录要检查的压缩文件，残留的文件直接处理
+func (fk *fsck) scan(path string, d fs.DirEntry, err error) error {
+	if err != nil {
+		fk.addError(err)
+		return nil
+	}
+	if d.IsDir() {
+		if isMetaDir(fk.backend, path) {
+			return fs.SkipDir
+		}
+		return nil
+	}
+	if !d.Type().IsRegular() {
+		return nil
+	}
+	switch {
+	case isTempName(d.Name()):
+		fk.orphanTemp(path)
+	case strings.HasSuffix(d.Name(), legacyRawSuffix) && isLegacyRaw(path):
+		fk.orphanRaw(path)
+	default:
+		fi, err := d.Info()
+		if err != nil {
+			fk.addError(err)
+			return nil
+		}
+		fk.files = append(fk.files, path)
+		fk.totalFiles++
+		fk.totalBytes += fi.Size()
+	}
+	return nil
+}
+
+// 解压一个文件，检查它是否完整
+func (fk *fsck) check(path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		fk.addError(err)
+		return
+	}
+	fk.bytesIn.Add(fi.Size())
+	// 修复时用纠错数据能修好的部分直接写回去
+	res := scrubOne(path, nil, nil, fk.repair)
+	n, err := res.off, res.err
+	fk.mu.Lock()
+	fk.report.Files++
+	fk.report.Bytes += n
+	fk.mu.Unlock()
+	if len(res.fixes) > 0 && err == nil {
+		p := fsckProblem{Path: fk.rel(path), Kind: problemRepairable, Offset: -1, Detail: formatFixes(res.fixes)}
+		if res.repaired {
+			p.Action = "repaired"
+		}
+		fk.addProblem(p)
+		return
+	}
+	if err == nil {
+		return
+	}
+	fk.failed.Add(1)
+	p := fsckProblem{Path: fk.rel(path), Kind: problemKind(err), Error: err.Error(), Offset: n}
+	switch {
+	case p.Kind == problemLegacy:
+		// 不知道压缩方式，文件不一定坏了，不能修复也不隔离
+	case fk.repair && p.Kind != problemUnreadable:
+		fk.salvage(path, fi, &p)
+	case fk.quarantine != "":
+		if err := fk.moveToQuarantine(path); err != nil {
+			fk.addError(err)
+		} else {
+			p.Action = "quarantined"
+		}
+	}
+	fk.addProblem(p)
+}
+
+// 按错误判断问题的种类
+func problemKind(err error) string {
+	var errno syscall.Errno
+	switch {
+	case errors.Is(err, errLegacyCodec):
+		return problemLegacy
+	case errors.Is(err, errTruncated), errors.Is(err, io.ErrUnexpectedEOF):
+		return problemTruncated
+	case errors.As(err, &errno), errors.Is(err, os.ErrPermission):
+		return problemUnreadable
+	}
+	// errCorrupt、errBadBlock、errChecksum、解压器返回的错误（旧格式）、未知的压缩方式
+	return problemCorrupt
+}
+
+// 修复损坏的文件：原来的文件先复制到隔离目录，再把能恢复的部分写回
+func (fk *fsck) salvage(path string, fi os.FileInfo, p *fsckProblem) {
+	if err := fk.copyToQuarantine(path); err != nil {
+		fk.addError(err)
+		return
+	}
+	fc, err := os.Open(path)
+	if err != nil {
+		fk.addError(err)
+		return
+	}
+	defer fc.Close()
+	var size, lost int64
+	tmpPath, err := createTemp(filepath.Dir(path), fi, true, func(w io.Writer) error {
+		size, lost, err = salvageFile(fc, w)
+		return err
+	})
+	if err != nil {
+		// 文件头都无法读取，没有能恢复的数据，只隔离
+		if err := fk.moveToQuarantine(path); err != nil {
+			fk.addError(err)
+			return
+		}
+		p.Action = "quarantined"
+		p.Detail = "无法修复：" + err.Error()
+		return
+	}
+	// 替换前把恢复出来的文件完整解压一遍
+	if err := verifyFile(tmpPath, size); err != nil {
+		os.Remove(tmpPath)
+		fk.addError(fmt.Errorf("%s：%v", path, err))
+		return
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		fk.addError(err)
+		return
+	}
+	p.Action = "repaired"
+	p.Detail = "恢复了" + formatSize(size)
+	if lost > 0 {
+		p.Detail += fmt.Sprintf("，其中%s无法解压、变成了0", formatSize(lost))
+	}
+}
+
+// 残留的临时文件：压缩完成后才会rename，所以临时文件不会是唯一的一份数据，修复时直接删除
+func (fk *fsck) orphanTemp(path string) {
+	p := fsckProblem{Path: fk.rel(path), Kind: problemOrphanTemp, Offset: -1}
+	switch {
+	case fk.repair:
+		if err := os.Remove(path); err != nil {
+			fk.addError(err)
+		} else {
+			p.Action = "removed"
+		}
+	case fk.quarantine != "":
+		if err := fk.moveToQuarantine(path); err != nil {
+			fk.addError(err)
+		} else {
+			p.Action = "quarantined"
+		}
+	}
+	fk.addProblem(p)
+}
+
+// 旧版本残留的解压文件 name.compressfs.raw：里面可能有还没有压缩写回的修改。
+// 修复时如果它比压缩文件新（或者压缩文件不存在），先把它压缩成name，再把它移到隔离目录
+func (fk *fsck) orphanRaw(path string) {
+	p := fsckProblem{Path: fk.rel(path), Kind: problemOrphanRaw, Offset: -1}
+	defer func() { fk.addProblem(p) }()
+	if !fk.repair && fk.quarantine == "" {
+		return
+	}
+	if fk.repair {
+		dst := strings.TrimSuffix(path, legacyRawSuffix)
+		raw, err := os.Stat(path)
+		if err != nil {
+			fk.addError(err)
+			return
+		}
+		meta, err := os.Stat(dst)
+		if err != nil || raw.ModTime().After(meta.ModTime()) {
+			if err := fk.recoverRaw(path, dst, meta); err != nil {
+				fk.addError(err)
+				return
+			}
+			p.Action = "recovered"
+			p.Detail = "压缩写回了" + fk.rel(dst) + "，解压文件移到了隔离目录"
+		}
+	}
+	if err := fk.moveToQuarantine(path); err != nil {
+		fk.addError(err)
+		return
+	}
+	if p.Action == "" {
+		p.Action = "quarantined"
+	}
+}
+
+// 判断name.compressfs.raw是不是旧版本残留的解压文件。这个后缀也是合法的文件名，
+// 所以只有不是块格式、按旧格式也解压不了的才算，其他的当作普通的压缩文件检查
+func isLegacyRaw(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, len(formatMagic))
+	n, _ := io.ReadFull(f, head)
+	if string(head[:n]) == formatMagic {
+		return false
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+	// 没有指定-legacy-codec时分不出来
+	_, err = decodeFile(f, io.Discard)
+	return err != nil && !errors.Is(err, errLegacyCodec)
+}
+
+// 把旧版本残留的解压文件压缩写回dst，原来的dst先复制到隔离目录
+func (fk *fsck) recoverRaw(path, dst string, meta os.FileInfo) error {
+	if meta != nil {
+		if err := fk.copyToQuarantine(dst); err != nil {
+			return err
+		}
+	}
+	fr, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	fi, err := fr.Stat()
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		meta = fi
+	}
+	return writeCompressed(dst, fr, fi.Size(), CompressType, meta, true)
+}
+
+// 相对于backend的路径
+func (fk *fsck) rel(path string) string {
+	if rel, err := filepath.Rel(fk.backend, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+// 把文件移到隔离目录里同样的相对路径下
+func (fk *fsck) moveToQuarantine(path string) error {
+	dst := filepath.Join(fk.quarantine, fk.rel(path))
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	return os.Rename(path, dst)
+}
+
+// 把文件复制到隔离目录里同样的相对路径下（修复之前保存原来的文件）
+func (fk *fsck) copyToQuarantine(path string) error {
+	dst := filepath.Join(fk.quarantine, fk.rel(path))
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, src)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+func (fk *fsck) addProblem(p fsckProblem) {
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	fk.report.Problems = append(fk.report.Problems, p)
+}
+
+func (fk *fsck) addError(err error) {
+	fmt.Fprintln(os.Stderr, "[ERROR]", err)
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	fk.report.Errors = append(fk.report.Errors, err.Error())
+}
@@ -1,19 +1,20 @@
 // TODO：性能优化：read和write不打开文件，file属性里面存一个*os.File
-// TODO：增加access time，根据访问时间进行缓存的删除
 // TODO：支持目录和权限修改
 // TODO：支持连接
 // TODO：通过文件名保存文件大小
-// TODO：优化同时打开同一个文件的问题（并发读）
+// TODO：服务端复制（copy_file_range、FICLONE），直接复制压缩文件，不用解压再压缩。需要 bazil.org/fuse 先支持 FUSE_COPY_FILE_RANGE 和 FUSE_IOCTL
 package main
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -37,6 +38,21 @@ var filesys FS
 // inode到对象的索引
 var inodeMap = make(map[uint64]interface{})
 
+// 开启内核的写回缓存：写入先留在内核的页缓存里，之后再批量交给compressfs
+var KernelWritebackCache bool
+
+// 内核预读的大小上限（字节），bazil.org/fuse默认为0，也就是不预读
+var MaxReadahead uint32
+
+// FUSE服务，用来通知内核丢弃缓存
+var server *fs.Server
+
+// 挂载以来读取时发现的校验和错误次数
+var ChecksumErrors atomic.Int64
+
+// 保护目录树（目录的files、directories和inodeMap）。需要同时持有File.mu时，先拿treeLock
+var treeLock sync.RWMutex
+
 // 定义一个“文件系统”结构体 https://godoc.org/bazil.org/fuse/fs#FS
 type FS struct {
 	root *Dir // 这里我们给这个结构体加了一个root属性，其值为一个目录结构体，表示根目录
@@ -56,66 +72,131 @@ type Node struct {
 	fullPath string //所在目录路径。如果是目录，则fullPath包含自身名称。FUSE根目录为空，其绝对路径为BackendDir+fullPath（BackendDir和fullPath都以/结尾）
 }
 
-// 目录结构体，自定义的，继承了Node结构体，一个目录下包含一些文件和目录
+// 目录结构体，自定义的，继承了Node结构体，一个目录下包含一些文件、目录和特殊文件
 type Dir struct {
 	Node
 	files       map[string]*File
 	directories map[string]*Dir
+	specials    map[string]*Special
+}
+
+// 判断目录下有没有这个名字的文件、目录或特殊文件。调用时需持有treeLock
+func (d *Dir) exists(name string) bool {
+	_, isFile := d.files[name]
+	_, isDir := d.directories[name]
+	_, isSpecial := d.specials[name]
+	return isFile || isDir || isSpecial
+}
+
+// 检查要创建（或者重命名成）的名字：压缩时用的临时文件名是保留的，backend里这样的文件挂载时会被当作残留的临时文件删除；
+// 根目录下的.compressfs是compressfs自己的目录（fsck、scrub用），挂载后看不到
+func (d *Dir) checkName(name string) error {
+	if isTempName(name) || (d == filesys.root && name == metaDirName) {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	return nil
+}
+
+// 判断目录是不是空的。调用时需持有treeLock
+func (d *Dir) empty() bool {
+	return len(d.files) == 0 && len(d.directories) == 0 && len(d.specials) == 0
 }
 
 // 文件结构体，自定义的，继承了Node结构体
 type File struct {
 	Node
-	rawPath   string   //如果为空，说明没有解压。解压后这里设置为解压后的路径。release时再压缩写入。
-	modified  bool     //如果为true，release后压缩写入，否则不进行操作
-	file      *os.File // 文件指针
-	flag      int      // 文件打开的Flag，参考：https://godoc.org/bazil.org/fuse#OpenFlags
-	openCount int      // 文件同时打开的次数，Open的时候+1，Relase的时候-1，如果为0，再删除解压后的文件
+	mu           sync.Mutex  // 保护解压、压缩和缓存淘汰
+	rawPath      string      //如果为空，说明没有解压。解压后这里设置为解压后的路径（在CacheDir里）。release时再压缩写入。
+	rawSize      int64       //解压后文件的大小，用于统计缓存占用
+	atime        time.Time   //最后一次访问的时间，缓存按这个时间淘汰
+	backendMtime time.Time   //解压时压缩文件的修改时间，用于判断缓存是否过期
+	backendSize  int64       //解压时压缩文件的大小，用于判断缓存是否过期
+	modified     bool        //如果为true，release后压缩写入（或者标记为脏，由后台压缩），否则不进行操作。用setModified、clearModified修改
+	dirtyTime    time.Time   //最后一次被标记为脏的时间，后台压缩按这个时间计算写回延迟
+	file         *os.File    // 解压后文件的文件指针，以读写方式打开，所有句柄共用
+	openCount    int         // 文件同时打开的次数，Open的时候+1，Relase的时候-1，如果为0，解压后的文件留在缓存里
+	unlinked     bool        // 文件已经被删除（或者被rename覆盖），但是还有句柄打开着
+	backendMode  os.FileMode // 压缩文件的权限，文件被删除后Attr用这个
+	locks        lockState   // 文件锁，由lockMu保护
+}
+
+// 文件句柄，每次Open都返回一个新的句柄，记录这次打开的Flag https://godoc.org/bazil.org/fuse/fs#Handle
+type FileHandle struct {
+	file  *File
+	flags fuse.OpenFlags // 这次打开的Flag，参考：https://godoc.org/bazil.org/fuse#OpenFlags
 }
 
 // 目录结构体的Attr()方法，返回目录属性
 func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 	//fmt.Println("[Attr]", d.name)
+	if err := checkAccess(ctx); err != nil {
+		return err
+	}
 	a.Inode = d.inode
-	a.Mode = os.ModeDir | 0555 // TODO: 优化权限
+	fi, err := os.Stat(BackendDir + d.fullPath)
+	if err != nil {
+		return toErrno(err)
+	}
+	a.Mode = fi.Mode()
+	a.Mtime = fi.ModTime()
+	setOwner(a, fi)
+	overrideAttr(a)
 	return nil
 }
 
 // 文件结构体的Attr()方法，返回文件属性 https://godoc.org/bazil.org/fuse#Attr
 func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 	// TODO: 支持所有attr
-	//TODO：增加access time，根据访问时间进行缓存的删除
 	fmt.Println("[Attr]", f.fullPath+f.name, "Inode:", f.inode)
+	if err := checkAccess(ctx); err != nil {
+		return err
+	}
 	a.Inode = f.inode
+	defer overrideAttr(a)
 
-	//打开压缩文件
-	fr, err := os.Open(BackendDir + f.fullPath + f.name)
-	if err != nil {
-		fmt.Println("[ERROR]Attr打开文件失败！", err)
-		return err
+	// 已经被删除但是还打开着的文件，压缩文件已经没有了，从解压后的文件获取属性
+	f.mu.Lock()
+	if f.unlinked {
+		defer f.mu.Unlock()
+		a.Mode = f.backendMode
+		a.Size = uint64(f.rawSize)
+		a.Nlink = 0
+		if fi, err := os.Stat(f.rawPath); err == nil {
+			a.Mtime = fi.ModTime()
+		}
+		return nil
 	}
-	defer fr.Close()
+	f.mu.Unlock()
 
 	//读取基本信息
-	fileInfo, _ := fr.Stat()
+	path := BackendDir + f.fullPath + f.name
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		fmt.Println("[ERROR]Attr打开文件失败！", err)
+		return toErrno(err)
+	}
 	a.Mode = fileInfo.Mode()
 	a.Mtime = fileInfo.ModTime()
+	setOwner(a, fileInfo)
 
-	// 获取文件大小
-	if f.rawPath != "" {
-		a.Size = getFileSize(f.rawPath)
+	// 获取文件大小，如果有解压缓存（并且压缩文件没有在外部被修改过），直接用缓存的大小
+	f.mu.Lock()
+	rawPath, rawSize := f.rawPath, f.rawSize
+	if rawPath != "" && !f.modified && !f.backendUnchanged() {
+		rawPath = ""
+		f.invalidate()
+	}
+	f.mu.Unlock()
+	if rawPath != "" {
+		a.Size = uint64(rawSize)
 	} else {
-		//打开读取器
-		r, err := NewReader(fr)
+		// 块格式只需要读文件末尾，旧格式需要解压一遍统计大小
+		n, err := decodedSize(path)
 		if err != nil {
-			fmt.Println("[getFileSize ERROR, NewReader]", err)
-			a.Size = uint64(0)
+			fmt.Println("[ERROR]Attr 解压失败", f.name, err)
+			return toErrno(err)
 		}
-		defer r.Close()
-		//读取压缩文件
-		buf := bytes.NewBuffer(nil)
-		io.Copy(buf, r)
-		a.Size = uint64(buf.Len())
+		a.Size = uint64(n)
 	}
 	return nil
 }
@@ -125,12 +206,29 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 	// TODO: 支持所有attr
 	fmt.Println("[Setattr]", f.fullPath+f.name, "Inode:", f.inode)
 	fmt.Println(req)
+	if err := checkAccess(ctx); err != nil {
+		return err
+	}
 
 	if req.Valid.Size() {
-		// 不知道是不是一定会先open文件才truncate的，如果不是，这里需要判断f.file是否打开，如果没打开，则需要打开，然后再truncate
-		err := f.file.Truncate(int64(req.Size))
+		if err := checkWritable(); err != nil {
+			return err
+		}
+		// 文件不一定是打开的（例如truncate(2)），truncate会在需要的时候先解压
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		err := f.truncate(int64(req.Size))
 		if err != nil {
 			fmt.Println("[ERROR]Setattr Size", err.Error())
+			return toErrno(err)
+		}
+		// 没有句柄打开这个文件，马上写回；否则等最后一个句柄关闭时写回
+		if f.openCount == 0 {
+			if err := f.commit(); err != nil {
+				fmt.Println("[ERROR]Setattr 压缩文件失败！", err.Error())
+				return toErrno(err)
+			}
+			cache.evict()
 		}
 	}
 	return nil
@@ -139,6 +237,11 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 // 查找目录下有没有这个文件或目录，返回对应的node https://godoc.org/bazil.org/fuse/fs#NodeStringLookuper
 func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	//fmt.Println("[Lookup]Dir:", d.name, "Name:", name)
+	if err := checkAccess(ctx); err != nil {
+		return nil, err
+	}
+	treeLock.RLock()
+	defer treeLock.RUnlock()
 	// 如果目录下有文件
 	if len(d.files) > 0 {
 		for _, v := range d.files {
@@ -157,6 +260,10 @@ func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 			}
 		}
 	}
+	// 如果是特殊文件
+	if v, ok := d.specials[name]; ok {
+		return v, nil
+	}
 	// 找不到对应的文件或目录，返回 ENOENT
 	// ENOENT 即 Error NO ENTry/ENTity 即 没有这样的文件或目录
 	return nil, fuse.ENOENT
@@ -167,6 +274,11 @@ func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 // https://godoc.org/bazil.org/fuse#Dirent
 func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	//fmt.Println("[ReadDirAll]", d.name)
+	if err := checkAccess(ctx); err != nil {
+		return nil, err
+	}
+	treeLock.RLock()
+	defer treeLock.RUnlock()
 	var children []fuse.Dirent
 	// 遍历文件
 	if len(d.files) > 0 {
@@ -186,29 +298,68 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 				Name:  dir.name})
 		}
 	}
+	// 遍历特殊文件
+	for _, sp := range d.specials {
+		children = append(children, fuse.Dirent{
+			Inode: sp.inode,
+			Type:  direntType(sp.mode),
+			Name:  sp.name})
+	}
 	// 返回列表
 	return children, nil
 }
 
 // 创建文件 https://godoc.org/bazil.org/fuse/fs#NodeCreater
 func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-	fmt.Println("[Create]Dir:", d.fullPath, "Name:", req.Name)
+	fmt.Println("[Create]Dir:", d.fullPath, "Name:", req.Name, "Flags:", req.Flags)
+	if err := checkWritable(); err != nil {
+		return nil, nil, err
+	}
+	if err := checkAccess(ctx); err != nil {
+		return nil, nil, err
+	}
+	if err := d.checkName(req.Name); err != nil {
+		return nil, nil, err
+	}
+	treeLock.Lock()
+	defer treeLock.Unlock()
+	// 文件已经存在：O_EXCL则返回 EEXIST，否则当作普通的打开
+	if _, ok := d.directories[req.Name]; ok {
+		if req.Flags&fuse.OpenExclusive != 0 {
+			return nil, nil, fuse.EEXIST
+		}
+		return nil, nil, fuse.Errno(syscall.EISDIR)
+	}
+	if _, ok := d.specials[req.Name]; ok {
+		return nil, nil, fuse.EEXIST
+	}
+	if f, ok := d.files[req.Name]; ok {
+		if req.Flags&fuse.OpenExclusive != 0 {
+			return nil, nil, fuse.EEXIST
+		}
+		h, err := f.Open(ctx, &fuse.OpenRequest{Header: req.Header, Flags: req.Flags}, &resp.OpenResponse)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, h, nil
+	}
 	// 定义文件路径
 	path := BackendDir + d.fullPath + req.Name // 压缩后的存放路径
-	rawPath := path + ".compressfs.raw"        // 解压后的存放路径
-	// 创建文件
-	fc, err := os.Create(path)
-	defer fc.Close()
-	if err != nil {
+	inode := NewInode()
+	rawPath := cachePath(inode) // 解压后的存放路径
+	// 创建一个合法的空压缩文件，关闭前（或者异常退出时）别的程序读到的也是空文件
+	if err := createEmpty(path, req.Mode.Perm()&^req.Umask); err != nil {
 		fmt.Println("[ERROR]创建文件失败！", err.Error())
+		return nil, nil, toErrno(err)
 	}
 	// 创建raw文件
-	fc2, err := os.Create(rawPath) // 暂时不Close（Create和Open一样，需要返回Handle，所以不能Close。）
+	fc2, err := os.OpenFile(rawPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600) // 暂时不Close（Create和Open一样，需要返回Handle，所以不能Close。）
 	if err != nil {
 		fmt.Println("[ERROR]创建文件失败！", err.Error())
+		os.Remove(path)
+		return nil, nil, toErrno(err)
 	}
-	// 构造一个文件结构体
-	inode := NewInode()
+	// 构造一个文件结构体，标记为被修改，这样空文件关闭时也会写入合法的压缩数据
 	f := &File{
 		Node: Node{
 			name:     req.Name,
@@ -216,43 +367,101 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 			fullPath: d.fullPath,
 		},
 		rawPath:   rawPath,
-		modified:  false,
+		atime:     time.Now(),
 		file:      fc2,
-		flag:      os.O_WRONLY | os.O_CREATE,
 		openCount: 1,
 	}
+	f.setModified()
+	f.saveBackendStat()
 	inodeMap[inode] = f
+	cache.add(f)
 	// 把文件加到目录的文件map里
 	d.files[f.name] = f
-	// 返回Node
-	return f, f, nil
+	// 返回Node和Handle
+	return f, &FileHandle{file: f, flags: req.Flags}, nil
 }
 
 // 删除文件或目录 https://godoc.org/bazil.org/fuse#RemoveRequest
+// 删除正在打开的文件时，数据还可以通过已经打开的句柄读写，最后一个句柄关闭时才丢弃
 func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	fmt.Println("[Remove]Dir:", d.fullPath, "Name:", req.Name, "Dir:", req.Dir)
-	err := os.Remove(BackendDir + d.fullPath + req.Name) // 删除文件或空目录
-	if err != nil {
-		fmt.Println(err, BackendDir+d.fullPath+req.Name)
+	if err := checkWritable(); err != nil {
+		return err
 	}
-	// 如果是删除目录，判断是不是有目录；如果删除文件，先看有没有文件
-	if req.Dir && len(d.directories) > 0 {
+	if err := checkAccess(ctx); err != nil {
+		return err
+	}
+	treeLock.Lock()
+	defer treeLock.Unlock()
+	path := BackendDir + d.fullPath + req.Name
+	// rmdir
+	if req.Dir {
+		sub, ok := d.directories[req.Name]
+		if !ok {
+			if d.exists(req.Name) {
+				return fuse.Errno(syscall.ENOTDIR)
+			}
+			return fuse.ENOENT
+		}
+		if !sub.empty() {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+		if err := os.Remove(path); err != nil {
+			fmt.Println(err, path)
+			return toErrno(err)
+		}
 		delete(d.directories, req.Name)
+		delete(inodeMap, sub.inode)
 		return nil
-	} else if !req.Dir && len(d.files) > 0 {
-		delete(d.files, req.Name)
+	}
+	// 删除特殊文件
+	if sp, ok := d.specials[req.Name]; ok {
+		if err := os.Remove(path); err != nil {
+			fmt.Println(err, path)
+			return toErrno(err)
+		}
+		delete(d.specials, req.Name)
+		delete(inodeMap, sp.inode)
 		return nil
 	}
-	// 返回 ENOENT
-	return fuse.ENOENT
+	// unlink
+	f, ok := d.files[req.Name]
+	if !ok {
+		if _, isDir := d.directories[req.Name]; isDir {
+			return fuse.Errno(syscall.EISDIR)
+		}
+		return fuse.ENOENT
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		fmt.Println(err, path)
+		return toErrno(err)
+	}
+	f.unlink()
+	delete(d.files, req.Name)
+	delete(inodeMap, f.inode)
+	return nil
 }
 
 // 创建目录 https://godoc.org/bazil.org/fuse/fs#NodeMkdirer
 func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
 	fmt.Println("[Mkdir]", d.fullPath, "Name:", req.Name, "Mode:", req.Mode)
+	if err := checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkAccess(ctx); err != nil {
+		return nil, err
+	}
+	if err := d.checkName(req.Name); err != nil {
+		return nil, err
+	}
+	treeLock.Lock()
+	defer treeLock.Unlock()
 	path := BackendDir + d.fullPath + req.Name
 	// 创建目录
-	os.Mkdir(path, req.Mode)
+	if err := os.Mkdir(path, req.Mode.Perm()&^req.Umask); err != nil {
+		fmt.Println("[ERROR]创建目录失败！", err)
+		return nil, toErrno(err)
+	}
 	// 构造一个目录结构体
 	inode := NewInode()
 	f := &Dir{
@@ -263,6 +472,7 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 		},
 		files:       make(map[string]*File),
 		directories: make(map[string]*Dir),
+		specials:    make(map[string]*Special),
 	}
 	inodeMap[inode] = f
 	// 把新建的目录加到目录的目录列表里
@@ -273,216 +483,627 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 // 打开文件 https://godoc.org/bazil.org/fuse/fs#NodeOpener
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
 	fmt.Println("[Open]", f.fullPath+f.name, "Inode:", f.inode, "Dir:", req.Dir, "Flags:", req.Flags)
-	// TODO: 允许多文件同时打开，目前禁止并发读，直接阻塞
-	for f.openCount > 0 {
-		time.Sleep(time.Millisecond)
+	if err := checkAccess(ctx); err != nil {
+		return nil, err
 	}
+	if !req.Flags.IsReadOnly() {
+		if err := checkWritable(); err != nil {
+			return nil, err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	// 并发打开计数器+1
 	f.openCount += 1
+	f.atime = time.Now()
+	// 压缩文件自从上次打开以后没有在外部被修改过，内核的页缓存还是有效的，不用丢弃
+	keepCache := f.modified || f.unlinked || (!f.backendMtime.IsZero() && f.backendUnchanged())
+	// 解压文件并打开解压后的文件
+	if err := f.load(); err != nil {
+		f.openCount -= 1
+		return nil, toErrno(err)
+	}
+	if err := f.openRaw(); err != nil {
+		f.openCount -= 1
+		return nil, toErrno(err)
+	}
+	// O_TRUNC：清空文件
+	if req.Flags&fuse.OpenTruncate != 0 && !req.Flags.IsReadOnly() {
+		if err := f.truncate(0); err != nil {
+			fmt.Println("[ERROR]清空文件错误", err)
+			f.openCount -= 1
+			return nil, toErrno(err)
+		}
+	}
+	if keepCache {
+		resp.Flags |= fuse.OpenKeepCache
+	}
+	//返回文件Handle，每次打开都是一个新的Handle
+	return &FileHandle{file: f, flags: req.Flags}, nil
+}
+
+// 如果还没有解压（或者缓存已经过期），则把文件解压到缓存里。调用时需持有f.mu
+func (f *File) load() error {
 	// 定义路径
 	path := BackendDir + f.fullPath + f.name
-	rawPath := path + ".compressfs.raw"
+	rawPath := cachePath(f.inode)
+	// 如果有缓存，但是压缩文件在外部被修改过了，则删除缓存重新解压。
+	// 还有句柄打开着的话（f.file不为nil）不能删除，这些句柄和新的句柄要用同一个解压文件，等都关闭后再重新解压
+	if f.rawPath != "" && f.file == nil && !f.modified && !f.unlinked && !f.backendUnchanged() {
+		fmt.Println("[load]压缩文件已改变，删除缓存", f.name)
+		cache.drop(f)
+		f.invalidate()
+	}
 	// 如果未解压，则解压
 	if f.rawPath == "" {
 		f.rawPath = rawPath
 		// 打开压缩文件
 		fz, err := os.Open(path)
-		defer fz.Close()
 		if err != nil {
 			fmt.Println("[ERROR]打开压缩文件错误", err)
+			f.rawPath = ""
+			return err
+		}
+		defer fz.Close()
+		// 有缓存上限的话，先按解压后的大小申请缓存空间再解压，避免大文件解压到一半就超过上限（例如占满tmpfs）。
+		// 旧格式的文件要先解压一遍才知道大小；文件末尾坏了读不出大小的话，解压完再申请
+		var reserved int64
+		if CacheSize > 0 {
+			if size, err := decodedSize(path); err == nil {
+				if err := cache.reserve(size); err != nil {
+					fmt.Println("[ERROR]缓存空间不足", f.name, size)
+					f.rawPath = ""
+					return err
+				}
+				reserved = size
+			}
 		}
 		// 创建解压后的文件
-		fr, err := os.OpenFile(rawPath, os.O_WRONLY|os.O_CREATE, 0600)
+		fr, err := os.OpenFile(rawPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 		if err != nil {
 			fmt.Println("[ERROR]创建解压文件错误", err)
+			cache.reserve(-reserved)
+			f.rawPath = ""
+			return err
+		}
+		// 解压文件，空洞直接跳过，解压后的文件也是稀疏的。
+		// 解压失败（压缩文件损坏或者被截断）的话不能继续用，否则写回时会丢数据
+		n, fixes, err := decodeFileFixes(fz, fr)
+		if cerr := fr.Close(); err == nil {
+			err = cerr
+		}
+		// 压缩文件坏了一点，已经用纠错数据修复，读到的数据是对的。磁盘上的文件由scrub或者fsck -repair修复
+		if len(fixes) > 0 {
+			fmt.Println("[load]用纠错数据修复了", path, formatFixes(fixes), "累计", ParityRepairs.Add(1), "次，请运行scrub修复磁盘上的文件")
+		}
+		if errors.Is(err, errChecksum) {
+			fmt.Println("[ERROR]校验和错误，数据已损坏！", path, "偏移", n, "累计", ChecksumErrors.Add(1), "次")
 		}
-		// 打开读取器
-		r, err := NewReader(fz)
-		if err != nil {
-			fmt.Println(err.Error())
-			return nil, nil
-		}
-		defer r.Close()
-		// 解压文件
-		io.Copy(fr, r)
-		// 关闭文件
-		fr.Close()
-	}
-	// 如果文件没被打开过，则打开文件
-	if f.file == nil {
-		flags := int(req.Flags)
-		fr, err := os.OpenFile(rawPath, flags, 0755)
 		if err != nil {
-			fmt.Println("[ERROR]打开解压后的文件错误", err)
-		}
-		f.file = fr
-		f.flag = int(req.Flags)
-		/* TODO：优化并发读
-		// 如果是RDONLY，则复制一个Node返回，否则把文件指针赋值到原Node的file
-		if int(req.Flags) == os.O_RDONLY {
-			fr, err := os.OpenFile(rawPath, os.O_RDONLY, 0755)
-			if err != nil {
-				fmt.Println("[ERROR]打开解压后的文件错误", err)
-			}
-			// 只读模式，构造一个新的Node返回，从而实现可以多次Open文件进行读取
-			fn := &File{
-				Node: Node{
-					name:     f.name,
-					inode:    f.inode,
-					fullPath: f.fullPath,
-				},
-				rawPath: f.rawPath,
-				file:    fr,
-				flag:    os.O_RDONLY,
-			} // os.O_RDONLY == 0 详见：https://godoc.org/syscall#O_RDONLY
-			//返回文件Handle
-			return fn, nil
-		} else {
-			flags := int(req.Flags)
-			fr, err := os.OpenFile(rawPath, flags, 0755)
-			if err != nil {
-				fmt.Println("[ERROR]打开解压后的文件错误", err)
-			}
-			f.file = fr
-			f.flag = int(req.Flags)
+			fmt.Println("[ERROR]解压文件错误", f.name, err)
+			os.Remove(rawPath)
+			cache.reserve(-reserved)
+			f.rawPath = ""
+			return err
+		}
+		// 按实际解压的大小修正申请的缓存空间
+		if err := cache.reserve(n - reserved); err != nil {
+			fmt.Println("[ERROR]缓存空间不足", f.name, n)
+			os.Remove(rawPath)
+			cache.reserve(-reserved)
+			f.rawPath = ""
+			return err
 		}
-		*/
+		f.rawSize = n
+		f.saveBackendStat()
+		cache.add(f)
+		mg.read(f)
 	}
-	//返回文件Handle
-	return f, nil
+	return nil
+}
+
+// 如果文件没被打开过，则以读写方式打开解压后的文件，之后的句柄都共用这个文件指针。调用时需持有f.mu
+func (f *File) openRaw() error {
+	if f.file != nil {
+		return nil
+	}
+	fr, err := os.OpenFile(f.rawPath, os.O_RDWR, 0600)
+	if err != nil {
+		fmt.Println("[ERROR]打开解压后的文件错误", err)
+		return err
+	}
+	f.file = fr
+	return nil
+}
+
+// 修改解压后文件的大小，变大的部分填0，并把文件标记为被修改。文件没有解压的话先解压。调用时需持有f.mu
+func (f *File) truncate(size int64) error {
+	if err := f.load(); err != nil {
+		return err
+	}
+	if err := cache.reserve(size - f.rawSize); err != nil {
+		return err
+	}
+	if err := os.Truncate(f.rawPath, size); err != nil {
+		cache.reserve(f.rawSize - size)
+		return err
+	}
+	f.rawSize = size
+	f.setModified()
+	return nil
 }
 
 // 读取文件 https://godoc.org/bazil.org/fuse/fs#HandleReader
-func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+func (h *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	f := h.file
 	fmt.Println("[Read]", f.fullPath+f.name, "Inode:", f.inode, "Dir:", req.Dir, "Size:", req.Size, "Offset:", req.Offset)
+	// 只写方式打开的句柄不能读。开启内核写回缓存时，内核写不满一页会通过只写的句柄先读出来
+	if h.flags.IsWriteOnly() && !KernelWritebackCache {
+		return fuse.Errno(syscall.EBADF)
+	}
 	// 读取解压后的文件，赋值到 resp.Data
-	f.file.ReadAt(resp.Data[:req.Size], req.Offset)
+	n, err := f.file.ReadAt(resp.Data[:req.Size], req.Offset)
+	if err != nil && err != io.EOF {
+		fmt.Println("[ERROR]读取文件错误", err)
+		return toErrno(err)
+	}
 	// 调整切片长度，详见切片机制：https://blog.csdn.net/u013474436/article/details/88770501
-	resp.Data = resp.Data[:req.Size]
+	resp.Data = resp.Data[:n]
 	return nil
 }
 
-// 写入文件 https://godoc.org/bazil.org/fuse/fs#HandleWriter 【文件变小的时候会有bug】
-func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+// 写入文件 https://godoc.org/bazil.org/fuse/fs#HandleWriter
+func (h *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	f := h.file
 	resp.Size = len(req.Data)
-	fmt.Println("[Write]", f.fullPath+f.name, "Inode:", f.inode, "Size:", resp.Size, "Offset:", req.Offset, "Flags:", req.Flags, "FileFlags:", req.FileFlags)
-	// 如果flag是只读，则返回错误
-	if f.flag == os.O_RDONLY {
-		return fuse.EPERM // EPERM 操作不允许 参考：https://godoc.org/bazil.org/fuse#pkg-constants https://blog.csdn.net/a8039974/article/details/25830705
+	fmt.Println("[Write]", f.fullPath+f.name, "Inode:", f.inode, "Size:", resp.Size, "Offset:", req.Offset, "Flags:", req.Flags, "FileFlags:", h.flags)
+	// 只读方式打开的句柄不能写，返回 EBADF
+	if h.flags.IsReadOnly() {
+		return fuse.Errno(syscall.EBADF)
+	}
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// O_APPEND：总是写到文件末尾。开启内核写回缓存时由内核算好了位置
+	offset := req.Offset
+	if h.flags&fuse.OpenAppend != 0 && !KernelWritebackCache {
+		offset = f.rawSize
+	}
+	// 文件变大的话，先申请缓存空间
+	oldSize := f.rawSize
+	if end := offset + int64(len(req.Data)); end > f.rawSize {
+		if err := cache.reserve(end - f.rawSize); err != nil {
+			return err
+		}
+		f.rawSize = end
 	}
 	// 文件标记为被修改
-	f.modified = true
+	f.setModified()
 	// 写入文件
-	//fmt.Println(req.Data)
-	_, err := f.file.WriteAt(req.Data, req.Offset) // BUG: 文件大小可扩不可缩 写入的数据总是一堆0（py试试？）通过python的fuse测试，发现go的fuse缺少truncate操作
-	//fmt.Println("Write", n, "bytes")
+	_, err := f.file.WriteAt(req.Data, offset)
 	if err != nil {
 		fmt.Println("[ERROR]写入文件错误", err)
+		// 写入失败，恢复文件大小
+		f.file.Truncate(oldSize)
+		cache.reserve(oldSize - f.rawSize)
+		f.rawSize = oldSize
+		return toErrno(err)
 	}
 	return nil
 }
 
+// 预分配空间或者打洞 https://godoc.org/bazil.org/fuse/fs#HandleFAllocater
+// 直接对解压后的文件执行fallocate，打出来的洞压缩时记录成空洞。
+// 注意：bazil.org/fuse 不处理 FUSE_LSEEK，lseek的SEEK_DATA/SEEK_HOLE由内核处理（整个文件都当作数据）
+func (h *FileHandle) FAllocate(ctx context.Context, req *fuse.FAllocateRequest) error {
+	f := h.file
+	fmt.Println("[FAllocate]", f.fullPath+f.name, "Inode:", f.inode, "Offset:", req.Offset, "Length:", req.Length, "Mode:", req.Mode)
+	if h.flags.IsReadOnly() {
+		return fuse.Errno(syscall.EBADF)
+	}
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	// 只支持预分配和打洞（打洞必须带KEEP_SIZE），其他模式（ZERO_RANGE、COLLAPSE_RANGE等）压缩时没法记录
+	switch req.Mode {
+	case 0, fuse.FAllocateKeepSize, fuse.FAllocateKeepSize | fuse.FAllocatePunchHole:
+	default:
+		return fuse.Errno(syscall.EOPNOTSUPP)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	offset, length := int64(req.Offset), int64(req.Length)
+	punch := req.Mode&fuse.FAllocatePunchHole != 0
+	keepSize := req.Mode&fuse.FAllocateKeepSize != 0
+	// 文件变大的话，先申请缓存空间
+	oldSize := f.rawSize
+	newSize := oldSize
+	if !keepSize && offset+length > oldSize {
+		newSize = offset + length
+		if err := cache.reserve(newSize - oldSize); err != nil {
+			return err
+		}
+	}
+	err := syscall.Fallocate(int(f.file.Fd()), uint32(req.Mode), offset, length)
+	if err == syscall.EOPNOTSUPP {
+		// 缓存目录所在的文件系统不支持，打洞就写0，预分配就只修改大小
+		err = nil
+		if punch && offset < oldSize {
+			end := offset + length
+			if end > oldSize {
+				end = oldSize
+			}
+			err = writeZerosAt(f.file, offset, end-offset)
+		} else if newSize > oldSize {
+			err = f.file.Truncate(newSize)
+		}
+	}
+	if err != nil {
+		fmt.Println("[ERROR]fallocate错误", err)
+		cache.reserve(oldSize - newSize)
+		return toErrno(err)
+	}
+	f.rawSize = newSize
+	f.setModified()
+	return nil
+}
+
 // 释放文件 https://godoc.org/bazil.org/fuse/fs#HandleReleaser
-func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+func (h *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	f := h.file
+	// 最后一次close，释放这次打开的flock锁
+	if req.ReleaseFlags&fuse.ReleaseFlockUnlock != 0 {
+		f.releaseLocks(req.LockOwner, true)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.openCount -= 1
+	f.atime = time.Now()
 	fmt.Println("[Release]", f.fullPath+f.name, "Inode:", f.inode, "rawPath:", f.rawPath, "openCount:", f.openCount, "modified:", f.modified)
-	// 如果是只读，直接返回 TODO: 优化并发读
-	// if f.flag == os.O_RDONLY {
-	// 	err := f.file.Close()
-	// 	if err != nil {
-	// 		fmt.Println("Close file error:", err)
-	// 	}
-	// }
-	// 定义路径变量
-	path := BackendDir + f.fullPath + f.name
-	rawPath := path + ".compressfs.raw"
-	// 如果文件被修改了，就重新压缩
-	if f.modified == true {
-		// 打开压缩文件
-		fz, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0600)
-		defer fz.Close()
-		if err != nil {
-			fmt.Println("[RROR]打开压缩文件失败！", f.name, err.Error())
-			return nil
-		}
-		// 打开写入器
-		w, err := NewWriter(fz)
-		if err != nil {
-			fmt.Println(err.Error())
-			return nil
-		}
-		defer w.Close()
-		// 关闭解压后的文件并重新打开
-		f.file.Close()
-		fr, err := os.OpenFile(rawPath, os.O_RDONLY, 0600)
-		defer fr.Close()
-		if err != nil {
-			fmt.Println("[ERROR]打开解压后文件失败！", f.name, err.Error())
-			return nil
-		}
-		// 写入
-		io.Copy(w, fr)
-		// 文件变成未修改
-		f.modified = false
-		// 清空文件指针和flag
-		f.file = nil
-		f.flag = 0
-	}
-	// 如果openCount为0，则删除解压后的文件
+	// 如果文件被修改了，就重新压缩（一般在Flush时已经压缩过了）
+	if err := f.commit(); err != nil {
+		fmt.Println("[ERROR]压缩文件失败！", f.name, err.Error())
+		f.closeRaw()
+		return toErrno(err)
+	}
+	f.closeRaw()
+	return nil
+}
+
+// 如果openCount为0，则关闭解压后的文件，解压后的文件留在缓存里，由缓存负责淘汰。调用时需持有f.mu
+func (f *File) closeRaw() {
+	if f.openCount > 0 {
+		return
+	}
+	f.file.Close()
+	f.file = nil
+	// 文件已经被删除了，解压后的文件也不要了
+	if f.unlinked {
+		f.clearModified()
+		cache.drop(f)
+	}
+	cache.evict()
+}
+
+// 文件被删除或者被覆盖了，修改不用再压缩了。没有句柄打开的话马上删除解压缓存，
+// 否则数据还可以通过已经打开的句柄读写，等最后一个句柄关闭时再删除
+func (f *File) unlink() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unlinked = true
+	wb.forget(f)
 	if f.openCount == 0 {
-		err := os.Remove(f.rawPath)
-		if err != nil {
-			fmt.Println("os.Remove error:", err)
-		}
-		f.rawPath = ""
+		f.clearModified()
+		cache.drop(f)
+	}
+}
+
+// 把文件标记为被修改，第一次修改时在缓存目录里记下它在backend里的路径，异常退出的话下次挂载时写回。调用时需持有f.mu
+func (f *File) setModified() {
+	if !f.modified {
+		f.saveDirtyPath()
+	}
+	f.modified = true
+}
+
+// 修改已经写回（或者文件被删除了，不用写回了）。调用时需持有f.mu
+func (f *File) clearModified() {
+	if f.modified {
+		os.Remove(dirtyPath(f.inode))
+	}
+	f.modified = false
+}
+
+// 在缓存目录里记下文件在backend里的路径，重命名后也要重新记录。先写临时文件再rename，异常退出时不会留下写了一半的路径。
+// 调用时需持有f.mu
+func (f *File) saveDirtyPath() {
+	path := dirtyPath(f.inode)
+	err := os.WriteFile(path+".tmp", []byte(f.fullPath+f.name), 0600)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		fmt.Println("[ERROR]记录修改过的文件失败！", f.fullPath+f.name, err)
+	}
+}
+
+// 把修改写回：开启了写回延迟的话，只标记为脏，由后台压缩，否则马上压缩。调用时需持有f.mu
+func (f *File) commit() error {
+	if !f.modified {
+		return nil
 	}
+	if WritebackDelay > 0 {
+		wb.mark(f)
+		return nil
+	}
+	return f.compress(false)
+}
+
+// 把解压后的文件重新压缩，写入BackendDir，压缩失败（例如磁盘满了）也不会破坏原来的压缩文件。
+// durable为true时保证数据已经落盘（fsync用）。调用时需持有f.mu
+func (f *File) compress(durable bool) error {
+	// 文件已经被删除了，不用压缩
+	if f.unlinked {
+		f.clearModified()
+		return nil
+	}
+	path := BackendDir + f.fullPath + f.name
+	// 打开解压后的文件
+	fr, err := os.Open(f.rawPath)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	fi, err := fr.Stat()
+	if err != nil {
+		return err
+	}
+	// 保持原来压缩文件的权限和所有者
+	meta, _ := os.Stat(path)
+	if err := writeCompressed(path, fr, fi.Size(), CompressType, meta, durable); err != nil {
+		return err
+	}
+	// 文件变成未修改
+	f.clearModified()
+	f.saveBackendStat()
 	return nil
 }
 
+// 记录压缩文件当前的修改时间和大小
+func (f *File) saveBackendStat() {
+	fi, err := os.Stat(BackendDir + f.fullPath + f.name)
+	if err != nil {
+		return
+	}
+	f.backendMtime = fi.ModTime()
+	f.backendSize = fi.Size()
+	f.backendMode = fi.Mode()
+}
+
+// 判断压缩文件自从上次解压或压缩以后有没有被修改
+func (f *File) backendUnchanged() bool {
+	fi, err := os.Stat(BackendDir + f.fullPath + f.name)
+	if err != nil {
+		return false
+	}
+	return fi.ModTime().Equal(f.backendMtime) && fi.Size() == f.backendSize
+}
+
+// 文件内容不是通过内核改变的（例如压缩文件在外部被修改了），通知内核丢弃这个文件的页缓存。
+// 在新的goroutine里通知，避免和内核里正在等待的读请求互相等待
+func (f *File) invalidate() {
+	if server == nil {
+		return
+	}
+	go func() {
+		err := server.InvalidateNodeData(f)
+		if err != nil && err != fuse.ErrNotCached {
+			fmt.Println("[ERROR]通知内核丢弃缓存失败！", f.name, err)
+		}
+	}()
+}
+
 // 同步文件修改到磁盘 https://godoc.org/bazil.org/fuse/fs#HandleFlusher
-func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+// close(2)的返回值来自Flush而不是Release，所以最后一个句柄关闭时在这里压缩，压缩失败的话应用可以看到错误
+func (h *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	f := h.file
 	fmt.Println("[Flush]", f.fullPath+f.name)
-	f.file.Sync()
+	// 进程关闭任何一个文件描述符，都会释放它在这个文件上的POSIX锁
+	f.releaseLocks(req.LockOwner, false)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.file.Sync(); err != nil {
+		return toErrno(err)
+	}
+	if f.openCount == 1 && WritebackDelay <= 0 {
+		if err := f.commit(); err != nil {
+			fmt.Println("[ERROR]压缩文件失败！", f.name, err.Error())
+			return toErrno(err)
+		}
+	}
 	return nil
 }
 
-// fsync（也是同步到磁盘） https://godoc.org/bazil.org/fuse/fs#NodeFsyncer
+// fsync https://godoc.org/bazil.org/fuse/fs#NodeFsyncer
+// 解压后的文件只是缓存，所以fsync要把文件马上压缩（不管有没有开启写回延迟），并保证压缩文件已经落盘
 func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
 	fmt.Println("[Fsync]", f.fullPath+f.name)
-	f.file.Sync()
-	return nil
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.unlinked {
+		return nil
+	}
+	if f.modified {
+		if err := f.compress(true); err != nil {
+			fmt.Println("[ERROR]Fsync 压缩文件失败！", f.name, err.Error())
+			return toErrno(err)
+		}
+		return nil
+	}
+	// 没有修改，但是之前的压缩可能还没有落盘
+	if err := syncFile(BackendDir + f.fullPath + f.name); err != nil {
+		return toErrno(err)
+	}
+	return toErrno(syncDir(BackendDir + f.fullPath))
+}
+
+// 目录的fsync，保证目录下的创建、删除、重命名已经落盘 https://godoc.org/bazil.org/fuse/fs#NodeFsyncer
+func (d *Dir) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	fmt.Println("[Fsync]Dir:", d.fullPath)
+	return toErrno(syncDir(BackendDir + d.fullPath))
 }
 
 // 重命名 仅是Dir结构体的方法（文档未写明） https://godoc.org/bazil.org/fuse/fs#NodeRenamer
+// 目标已经存在时原子地替换它，移动目录时目录下所有文件和子目录的路径都会更新，已经打开的句柄跟着文件走。
+// 注意：bazil.org/fuse 只处理 FUSE_RENAME，不处理带flags的 FUSE_RENAME2，
+// 所以 RENAME_NOREPLACE 和 RENAME_EXCHANGE 会被内核直接返回 EINVAL，不会到这里。
 func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
 	fmt.Println("[Rename]", d.name, req, newDir)
-	dstDir := inodeMap[uint64(req.NewDir)].(*Dir)
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	if err := checkAccess(ctx); err != nil {
+		return err
+	}
+	dstDir, ok := newDir.(*Dir)
+	if !ok {
+		return fuse.Errno(syscall.ENOTDIR)
+	}
+	if err := dstDir.checkName(req.NewName); err != nil {
+		return err
+	}
+	treeLock.Lock()
+	defer treeLock.Unlock()
+	srcFile, isFile := d.files[req.OldName]
+	srcDir, isDir := d.directories[req.OldName]
+	srcSpecial, isSpecial := d.specials[req.OldName]
+	if !isFile && !isDir && !isSpecial {
+		return fuse.ENOENT
+	}
+	// 重命名成自己，什么都不用做
+	if d == dstDir && req.OldName == req.NewName {
+		return nil
+	}
+	// 不能把目录移动到它自己的子目录里
+	if isDir && srcDir.isAncestorOf(dstDir) {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	// 检查目标：文件不能覆盖目录，目录不能覆盖文件，目录只能覆盖空目录
+	oldFile, hasOldFile := dstDir.files[req.NewName]
+	oldDir, hasOldDir := dstDir.directories[req.NewName]
+	oldSpecial, hasOldSpecial := dstDir.specials[req.NewName]
+	if (hasOldFile || hasOldSpecial) && isDir {
+		return fuse.Errno(syscall.ENOTDIR)
+	}
+	if hasOldDir && !isDir {
+		return fuse.Errno(syscall.EISDIR)
+	}
+	if hasOldDir && !oldDir.empty() {
+		return fuse.Errno(syscall.ENOTEMPTY)
+	}
+	// 先锁住要移动的文件（目录的话是它下面的所有文件），直到路径更新完。
+	// 否则后台写回可能在后端重命名之后、更新路径之前按旧的路径写backend
+	var moved []*File
+	if isFile {
+		moved = []*File{srcFile}
+	} else if isDir {
+		moved = srcDir.subtreeFiles(nil)
+	}
+	for _, f := range moved {
+		f.mu.Lock()
+	}
+	defer func() {
+		for _, f := range moved {
+			f.mu.Unlock()
+		}
+	}()
+	// 再重命名后端的压缩文件，os.Rename会原子地替换已经存在的目标
 	oldLocation := BackendDir + d.fullPath + req.OldName
 	newLocation := BackendDir + dstDir.fullPath + req.NewName
 	err := os.Rename(oldLocation, newLocation)
 	if err != nil {
 		fmt.Println(err)
-		return err
+		return toErrno(err)
 	}
-	s, err := os.Stat(newLocation)
-	if err != nil {
-		fmt.Println("os.Stat error:", err)
-		return err
+	// 被替换掉的目标
+	if hasOldFile {
+		oldFile.unlink()
+		delete(dstDir.files, req.NewName)
+		delete(inodeMap, oldFile.inode)
 	}
-	if s.IsDir() {
-		dstDir.directories[req.NewName] = d.directories[req.OldName]
-		dstDir.directories[req.NewName].name = req.NewName
-		dstDir.directories[req.NewName].fullPath = dstDir.fullPath + req.NewName + "/"
-		delete(d.directories, req.OldName)
-	} else {
-		dstDir.files[req.NewName] = d.files[req.OldName]
-		dstDir.files[req.NewName].name = req.NewName
-		dstDir.files[req.NewName].fullPath = dstDir.fullPath
+	if hasOldDir {
+		delete(inodeMap, oldDir.inode)
+	}
+	if hasOldSpecial {
+		delete(dstDir.specials, req.NewName)
+		delete(inodeMap, oldSpecial.inode)
+	}
+	// 更新目录树
+	if isFile {
 		delete(d.files, req.OldName)
+		srcFile.name = req.NewName
+		srcFile.fullPath = dstDir.fullPath
+		if srcFile.modified {
+			srcFile.saveDirtyPath()
+		}
+		dstDir.files[req.NewName] = srcFile
+	} else if isSpecial {
+		delete(d.specials, req.OldName)
+		srcSpecial.name = req.NewName
+		srcSpecial.fullPath = dstDir.fullPath
+		dstDir.specials[req.NewName] = srcSpecial
+	} else {
+		delete(d.directories, req.OldName)
+		srcDir.name = req.NewName
+		srcDir.setFullPath(dstDir.fullPath + req.NewName + "/")
+		dstDir.directories[req.NewName] = srcDir
 	}
 	return nil
 }
 
+// 判断d是不是other本身或者other的上级目录。调用时需持有treeLock
+func (d *Dir) isAncestorOf(other *Dir) bool {
+	if d == other {
+		return true
+	}
+	for _, sub := range d.directories {
+		if sub.isAncestorOf(other) {
+			return true
+		}
+	}
+	return false
+}
+
+// 把目录下（包括子目录里）的所有文件追加到files后面返回。调用时需持有treeLock
+func (d *Dir) subtreeFiles(files []*File) []*File {
+	for _, f := range d.files {
+		files = append(files, f)
+	}
+	for _, sub := range d.directories {
+		files = sub.subtreeFiles(files)
+	}
+	return files
+}
+
+// 修改目录的路径，目录下所有文件和子目录的路径也一起修改。调用时需持有treeLock和目录下所有文件的mu
+func (d *Dir) setFullPath(fullPath string) {
+	d.fullPath = fullPath
+	for _, f := range d.files {
+		f.fullPath = fullPath
+		if f.modified {
+			f.saveDirtyPath()
+		}
+	}
+	for _, sp := range d.specials {
+		sp.fullPath = fullPath
+	}
+	for _, sub := range d.directories {
+		sub.setFullPath(fullPath + sub.name + "/")
+	}
+}
+
 // ****************************************
 
 // 遍历目录，返回Dir结构体
@@ -502,19 +1123,35 @@ func readDir(name string, path string) *Dir {
 		},
 		files:       make(map[string]*File),
 		directories: make(map[string]*Dir),
+		specials:    make(map[string]*Special),
 	}
 	inodeMap[inode] = dir
 	for _, f := range dirInfos {
 		if f.IsDir() {
 			newDir := readDir(f.Name(), path+f.Name()+"/")
 			dir.directories[newDir.name] = newDir
+		} else if isSpecialMode(f.Mode()) {
+			// 特殊文件
+			inode := NewInode()
+			sp := &Special{
+				Node: Node{
+					name:     f.Name(),
+					inode:    inode,
+					fullPath: dir.fullPath,
+				},
+				mode: f.Mode().Type(),
+			}
+			inodeMap[inode] = sp
+			dir.specials[sp.name] = sp
 		} else {
-			// 如果是解压后的文件，则删除
-			if strings.HasSuffix(f.Name(), ".compressfs.raw") {
-				os.Remove(BackendDir + dir.fullPath + f.Name())
+			// 压缩时没有写完的临时文件，删除（只读挂载时只跳过）
+			if isTempName(f.Name()) {
+				if !ReadOnly {
+					os.Remove(path + f.Name())
+				}
 				continue
 			}
-			// 否则添加到文件列表
+			// 添加到文件列表
 			inode := NewInode()
 			file := &File{
 				Node: Node{
@@ -537,18 +1174,14 @@ func run() error {
 	// 	fmt.Println(msg)
 	// }
 
-	c, err := fuse.Mount( // see: https://godoc.org/bazil.org/fuse#MountOption
-		Mountpoint,
-		fuse.FSName("compressfs"),
-		fuse.Subtype("compressfs"),
-	)
+	c, err := fuse.Mount(Mountpoint, mountOptions()...) // see: https://godoc.org/bazil.org/fuse#MountOption
 	if err != nil {
 		return err
 	}
 	defer c.Close()
 
 	// 优雅退出
-	exitChan := make(chan os.Signal)
+	exitChan := make(chan os.Signal, 1)
 	signal.Notify(exitChan, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		for {
@@ -573,6 +1206,18 @@ func run() error {
 		BackendDir = BackendDir + "/"
 	}
 
+	// 初始化解压缓存目录
+	if err := initCache(); err != nil {
+		return err
+	}
+	defer cleanCache()
+	go cache.expireLoop()
+
+	// 启动后台压缩，卸载后先把修改过的文件都压缩完，同步到磁盘，再删除缓存目录
+	defer syscall.Sync()
+	wb.start()
+	defer wb.shutdown()
+
 	// 初始化根文件系统
 	inode := NewInode()
 	filesys.root = &Dir{
@@ -583,6 +1228,7 @@ func run() error {
 		},
 		files:       make(map[string]*File),
 		directories: make(map[string]*Dir),
+		specials:    make(map[string]*Special),
 	}
 	inodeMap[inode] = filesys.root
 
@@ -594,16 +1240,34 @@ func run() error {
 		os.Exit(1)
 	}
 	for _, f := range dirInfos {
+		if f.IsDir() && f.Name() == metaDirName {
+			continue
+		}
 		if f.IsDir() {
 			newDir := readDir(f.Name(), BackendDir+f.Name()+"/")
 			filesys.root.directories[newDir.name] = newDir
+		} else if isSpecialMode(f.Mode()) {
+			// 特殊文件
+			inode := NewInode()
+			sp := &Special{
+				Node: Node{
+					name:     f.Name(),
+					inode:    inode,
+					fullPath: "",
+				},
+				mode: f.Mode().Type(),
+			}
+			inodeMap[inode] = sp
+			filesys.root.specials[sp.name] = sp
 		} else {
-			// 如果是解压后的文件，则删除
-			if strings.HasSuffix(f.Name(), ".compressfs.raw") {
-				os.Remove(BackendDir + f.Name())
+			// 压缩时没有写完的临时文件，删除（只读挂载时只跳过）
+			if isTempName(f.Name()) {
+				if !ReadOnly {
+					os.Remove(BackendDir + f.Name())
+				}
 				continue
 			}
-			// 否则添加到文件列表
+			// 添加到文件列表
 			inode := NewInode()
 			file := &File{
 				Node: Node{
@@ -617,12 +1281,24 @@ func run() error {
 		}
 	}
 
+	// 读完目录树后再启动后台转换和巡检
+	mg.start()
+	defer mg.shutdown()
+	scrub.start()
+	defer scrub.shutdown()
+
 	// 调用 Serve
 	fmt.Println("[run]调用Serve")
-	srv := fs.New(c, nil)
-	if err := srv.Serve(&filesys); err != nil {
+	server = fs.New(c, &fs.Config{WithContext: withCaller})
+	if err := server.Serve(&filesys); err != nil {
 		return err
 	}
+	if n := ChecksumErrors.Load(); n > 0 {
+		fmt.Println("[run]挂载期间发现校验和错误", n, "次，请用fsck检查backend")
+	}
+	if n := ParityRepairs.Load(); n > 0 {
+		fmt.Println("[run]挂载期间用纠错数据修复了", n, "次，请用scrub修复磁盘上的文件")
+	}
 
 	return nil
 }
@@ -3,7 +3,14 @@ module compressfs
 go 1.19
 
 require (
-	bazil.org/fuse v0.0.0-20230120002735-62a210ff1fd5 // indirect
-	golang.org/x/net v0.7.0 // indirect
+	bazil.org/fuse v0.0.0-20230120002735-62a210ff1fd5
+	github.com/BurntSushi/toml v1.3.2
+	github.com/klauspost/compress v1.17.4
+	github.com/klauspost/reedsolomon v1.12.3
+	golang.org/x/net v0.7.0
+)
+
+require (
+	github.com/klauspost/cpuid/v2 v2.2.6 // indirect
 	golang.org/x/sys v0.5.0 // indirect
 )
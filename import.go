@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 导入：把一个普通的目录树直接压缩写入backend，不经过挂载。
+// 每个文件压缩完后才把压缩文件的修改时间设置成源文件的修改时间，所以修改时间和大小都相同的压缩文件
+// 说明已经导入过了，中断后重新运行会跳过它们，接着导入剩下的文件
+type importer struct {
+	batch
+	src     string
+	backend string
+	codec   string
+	files   []importFile // 要导入的普通文件
+	dirs    []importFile // 要设置权限和修改时间的目录，父目录在前
+}
+
+// 源目录里的一个文件或目录
+type importFile struct {
+	path string // 源文件路径
+	dst  string // 压缩文件路径
+	fi   os.FileInfo
+}
+
+// compressfs import [选项] SRC BACKEND
+func runImport(cmd *command, args []string) int {
+	fs := cmd.flagSet()
+	codec := fs.String("codec", "lzw", help("codec for the imported files: lzw, flate1, flate9, flate, gzip, zlib, zstd, optionally with a level and parity, e.g. zstd:9 or zstd:9,parity=10%", "导入的文件使用的压缩方式：lzw、flate1、flate9、flate、gzip、zlib、zstd，可以带级别和纠错数据，例如zstd:9、zstd:9,parity=10%"))
+	workers := fs.Int("workers", runtime.NumCPU(), help("number of files compressed in parallel", "同时压缩的文件数"))
+	quiet := fs.Bool("quiet", false, help("do not print progress", "不显示进度"))
+	if ok, code := cmd.parse(fs, args, 2, 2); !ok {
+		return code
+	}
+	if *workers < 1 {
+		fmt.Fprintln(os.Stderr, "并发数参数错误！", *workers)
+		return 2
+	}
+	codecName, err := canonicalCodec(*codec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "压缩参数错误！", err)
+		return 2
+	}
+	imp := &importer{
+		batch:   batch{tag: "import", ratioLabel: "压缩率", workers: *workers, quiet: *quiet},
+		src:     filepath.Clean(fs.Arg(0)),
+		backend: filepath.Clean(fs.Arg(1)),
+		codec:   codecName,
+	}
+	if err := imp.check(); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		return 2
+	}
+	CompressType = imp.codec
+
+	fmt.Println("[import]扫描", imp.src)
+	if err := filepath.WalkDir(imp.src, imp.scan); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		return 1
+	}
+	fmt.Printf("[import]%d个文件，共%s，压缩方式%s，并发数%d\n", imp.totalFiles, formatSize(imp.totalBytes), imp.codec, *workers)
+	if !imp.run(len(imp.files), func(i int) { imp.importFile(imp.files[i]) }) {
+		fmt.Printf("[import]已中断：处理了%d/%d个文件，重新运行同样的命令可以继续导入\n", imp.doneFiles.Load(), imp.totalFiles)
+		return 130
+	}
+	imp.finishDirs()
+	fmt.Printf("[import]完成：%d个文件（跳过已导入的%d个），%s -> %s，压缩率%s，失败%d个\n",
+		imp.doneFiles.Load(), imp.skipped.Load(), formatSize(imp.bytesIn.Load()), formatSize(imp.bytesOut.Load()),
+		formatRatio(imp.bytesOut.Load(), imp.bytesIn.Load()), imp.failed.Load())
+	if imp.failed.Load() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// 检查源目录和backend。backend不存在的话创建，但不能在源目录里面，否则会把导入的文件再导入一遍
+func (imp *importer) check() error {
+	fi, err := os.Stat(imp.src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s不是目录！", imp.src)
+	}
+	if err := os.MkdirAll(imp.backend, 0755); err != nil {
+		return err
+	}
+	src, err := filepath.Abs(imp.src)
+	if err != nil {
+		return err
+	}
+	backend, err := filepath.Abs(imp.backend)
+	if err != nil {
+		return err
+	}
+	if backend == src || strings.HasPrefix(backend, src+string(filepath.Separator)) {
+		return fmt.Errorf("backend %s不能在源目录%s里面！", imp.backend, imp.src)
+	}
+	return nil
+}
+
+// 扫描源目录：创建目录和特殊文件，记录要压缩的普通文件
+func (imp *importer) scan(path string, d fs.DirEntry, err error) error {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		imp.failed.Add(1)
+		return nil
+	}
+	if path == imp.src {
+		return nil
+	}
+	rel, err := filepath.Rel(imp.src, path)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(imp.backend, rel)
+	if isTempName(d.Name()) || isMetaDir(imp.src, path) {
+		fmt.Fprintln(os.Stderr, "[WARN]跳过和compressfs使用的文件重名的文件：", path)
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	}
+	fi, err := d.Info()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		imp.failed.Add(1)
+		return nil
+	}
+	switch {
+	case d.IsDir():
+		if err := imp.mkdir(dst); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]创建目录失败！", err)
+			imp.failed.Add(1)
+			return fs.SkipDir
+		}
+		imp.dirs = append(imp.dirs, importFile{path, dst, fi})
+	case fi.Mode()&os.ModeSymlink != 0:
+		fmt.Fprintln(os.Stderr, "[WARN]不支持符号链接，跳过：", path)
+	case isSpecialMode(fi.Mode()):
+		if err := makeSpecial(dst, fi); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]创建特殊文件失败！", err)
+			imp.failed.Add(1)
+		}
+	case fi.Mode().IsRegular():
+		imp.files = append(imp.files, importFile{path, dst, fi})
+		imp.totalFiles++
+		imp.totalBytes += fi.Size()
+	default:
+		fmt.Fprintln(os.Stderr, "[WARN]不支持的文件类型，跳过：", path)
+	}
+	return nil
+}
+
+// 创建目录。先用0700创建，保证后面能写入，导入完成后再设置源目录的权限。
+// 目录已经存在（上次导入中断）时删除里面残留的临时文件
+func (imp *importer) mkdir(dst string) error {
+	err := os.Mkdir(dst, 0700)
+	if err == nil || !os.IsExist(err) {
+		return err
+	}
+	entries, err := os.ReadDir(dst)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if isTempName(e.Name()) {
+			os.Remove(filepath.Join(dst, e.Name()))
+		}
+	}
+	return nil
+}
+
+// 创建和fi同样的特殊文件，已经存在的话不再创建
+func makeSpecial(dst string, fi os.FileInfo) error {
+	if _, err := os.Lstat(dst); err != nil {
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("%s：无法读取设备号", dst)
+		}
+		if err := syscall.Mknod(dst, unixMode(fi.Mode()), int(st.Rdev)); err != nil {
+			return fmt.Errorf("%s：%v", dst, err)
+		}
+	}
+	setMeta(dst, fi)
+	return nil
+}
+
+// 压缩一个文件。已经导入过的文件（修改时间和大小都相同）跳过
+func (imp *importer) importFile(job importFile) {
+	if fi, err := os.Stat(job.dst); err == nil && fi.ModTime().Equal(job.fi.ModTime()) {
+		if n, err := decodedSize(job.dst); err == nil && n == job.fi.Size() {
+			imp.skipped.Add(1)
+			imp.bytesIn.Add(n)
+			imp.bytesOut.Add(fi.Size())
+			return
+		}
+	}
+	if err := imp.compress(job); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]导入失败！", job.path, err)
+		imp.failed.Add(1)
+		return
+	}
+	imp.bytesIn.Add(job.fi.Size())
+	if fi, err := os.Stat(job.dst); err == nil {
+		imp.bytesOut.Add(fi.Size())
+	}
+}
+
+func (imp *importer) compress(job importFile) error {
+	fr, err := os.Open(job.path)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	if err := writeCompressed(job.dst, fr, job.fi.Size(), imp.codec, job.fi, false); err != nil {
+		return err
+	}
+	// 最后设置修改时间，作为已经导入完成的标记
+	return os.Chtimes(job.dst, time.Now(), job.fi.ModTime())
+}
+
+// 所有文件导入完成后，设置目录的权限、所有者和修改时间。子目录在前，避免修改子目录影响父目录的修改时间
+func (imp *importer) finishDirs() {
+	for i := len(imp.dirs) - 1; i >= 0; i-- {
+		d := imp.dirs[i]
+		if err := setMeta(d.dst, d.fi); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]设置目录属性失败！", err)
+			imp.failed.Add(1)
+		}
+	}
+}
+
+// 按源文件设置所有者、权限和修改时间。不是root的话不能修改所有者，忽略这个错误
+func setMeta(path string, fi os.FileInfo) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		os.Lchown(path, int(st.Uid), int(st.Gid))
+	}
+	if err := os.Chmod(path, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(path, time.Now(), fi.ModTime())
+}
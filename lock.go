@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// 文件锁：POSIX记录锁（fcntl）和BSD flock锁都由compressfs管理，两种锁互不影响。
+// 挂载时要传 fuse.LockingPOSIX() 和 fuse.LockingFlock()，内核才会把锁请求交给compressfs。
+// POSIX锁属于进程（LockOwner），任何一次close（Flush）都会释放；flock锁属于打开的文件，最后一次close（Release）时释放
+
+// 保护所有文件的锁表
+var lockMu sync.Mutex
+
+// 一把锁，范围是[start, end]（包含end），flock锁的范围是整个文件
+type fileLock struct {
+	owner fuse.LockOwner
+	flock bool
+	start uint64
+	end   uint64
+	typ   fuse.LockType
+	pid   int32
+}
+
+// 文件的锁表，由lockMu保护
+type lockState struct {
+	locks   []fileLock
+	changed chan struct{} // 有锁被释放时关闭，唤醒LockWait
+}
+
+// 判断两把锁是不是冲突：同一种锁、不同的owner、范围重叠，并且至少有一把是写锁
+func (l fileLock) conflicts(o fileLock) bool {
+	return l.flock == o.flock && l.owner != o.owner &&
+		l.start <= o.end && o.start <= l.end &&
+		(l.typ == fuse.LockWrite || o.typ == fuse.LockWrite)
+}
+
+// 返回和l冲突的锁。调用时需持有lockMu
+func (s *lockState) conflict(l fileLock) (fileLock, bool) {
+	for _, o := range s.locks {
+		if l.conflicts(o) {
+			return o, true
+		}
+	}
+	return fileLock{}, false
+}
+
+// 释放owner在[start, end]范围内的锁，部分重叠的锁会被拆开。调用时需持有lockMu
+func (s *lockState) remove(owner fuse.LockOwner, flock bool, start, end uint64) {
+	var locks []fileLock
+	removed := false
+	for _, o := range s.locks {
+		if o.owner != owner || o.flock != flock || o.end < start || end < o.start {
+			locks = append(locks, o)
+			continue
+		}
+		removed = true
+		if o.start < start {
+			left := o
+			left.end = start - 1
+			locks = append(locks, left)
+		}
+		if o.end > end {
+			right := o
+			right.start = end + 1
+			locks = append(locks, right)
+		}
+	}
+	s.locks = locks
+	if removed && s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// 加锁，没有冲突的话替换掉owner在这个范围内原来的锁。调用时需持有lockMu
+func (s *lockState) set(l fileLock) bool {
+	if _, ok := s.conflict(l); ok {
+		return false
+	}
+	// 读锁换成写锁，或者缩小范围，都要唤醒等待的请求
+	s.remove(l.owner, l.flock, l.start, l.end)
+	s.locks = append(s.locks, l)
+	return true
+}
+
+// 等待锁表变化。调用时需持有lockMu
+func (s *lockState) wait() <-chan struct{} {
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+	return s.changed
+}
+
+func newFileLock(req *fuse.LockRequest) fileLock {
+	return fileLock{
+		owner: req.LockOwner,
+		flock: req.LockFlags&fuse.LockFlock != 0,
+		start: req.Lock.Start,
+		end:   req.Lock.End,
+		typ:   req.Lock.Type,
+		pid:   req.Lock.PID,
+	}
+}
+
+// 加锁，有冲突则返回 EAGAIN https://godoc.org/bazil.org/fuse/fs#HandleLocker
+func (h *FileHandle) Lock(ctx context.Context, req *fuse.LockRequest) error {
+	f := h.file
+	fmt.Println("[Lock]", f.fullPath+f.name, req)
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	if !f.locks.set(newFileLock(req)) {
+		return fuse.Errno(syscall.EAGAIN)
+	}
+	return nil
+}
+
+// 加锁，有冲突则一直等到可以加锁，或者请求被中断
+func (h *FileHandle) LockWait(ctx context.Context, req *fuse.LockWaitRequest) error {
+	f := h.file
+	fmt.Println("[LockWait]", f.fullPath+f.name, req)
+	l := newFileLock((*fuse.LockRequest)(req))
+	for {
+		lockMu.Lock()
+		if f.locks.set(l) {
+			lockMu.Unlock()
+			return nil
+		}
+		changed := f.locks.wait()
+		lockMu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fuse.Errno(syscall.EINTR)
+		}
+	}
+}
+
+// 解锁
+func (h *FileHandle) Unlock(ctx context.Context, req *fuse.UnlockRequest) error {
+	f := h.file
+	fmt.Println("[Unlock]", f.fullPath+f.name, req)
+	l := newFileLock((*fuse.LockRequest)(req))
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	f.locks.remove(l.owner, l.flock, l.start, l.end)
+	return nil
+}
+
+// 查询锁（F_GETLK），有冲突的话返回其中一把冲突的锁
+func (h *FileHandle) QueryLock(ctx context.Context, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) error {
+	f := h.file
+	l := fileLock{
+		owner: req.LockOwner,
+		flock: req.LockFlags&fuse.LockFlock != 0,
+		start: req.Lock.Start,
+		end:   req.Lock.End,
+		typ:   req.Lock.Type,
+	}
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	if o, ok := f.locks.conflict(l); ok {
+		resp.Lock = fuse.FileLock{Start: o.start, End: o.end, Type: o.typ, PID: o.pid}
+	}
+	return nil
+}
+
+// 释放owner持有的所有POSIX锁或者flock锁（close的时候）
+func (f *File) releaseLocks(owner fuse.LockOwner, flock bool) {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	f.locks.remove(owner, flock, 0, ^uint64(0))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func posixLock(owner fuse.LockOwner, start, end uint64, typ fuse.LockType) fileLock {
+	return fileLock{owner: owner, start: start, end: end, typ: typ}
+}
+
+// 按顺序列出owner的锁的范围
+func lockRanges(s *lockState, owner fuse.LockOwner) [][2]uint64 {
+	var r [][2]uint64
+	for _, l := range s.locks {
+		if l.owner == owner {
+			r = append(r, [2]uint64{l.start, l.end})
+		}
+	}
+	for i := 1; i < len(r); i++ {
+		for j := i; j > 0 && r[j][0] < r[j-1][0]; j-- {
+			r[j], r[j-1] = r[j-1], r[j]
+		}
+	}
+	return r
+}
+
+func TestLockConflict(t *testing.T) {
+	var s lockState
+	if !s.set(posixLock(1, 0, 99, fuse.LockRead)) {
+		t.Fatal("加读锁失败")
+	}
+	// 读锁和读锁不冲突，和写锁冲突
+	if !s.set(posixLock(2, 50, 149, fuse.LockRead)) {
+		t.Fatal("两把读锁不应该冲突")
+	}
+	if s.set(posixLock(3, 90, 90, fuse.LockWrite)) {
+		t.Fatal("写锁和读锁重叠，应该冲突")
+	}
+	if !s.set(posixLock(3, 150, 200, fuse.LockWrite)) {
+		t.Fatal("不重叠的写锁不应该冲突")
+	}
+	// 同一个owner的锁不冲突
+	if !s.set(posixLock(3, 160, 170, fuse.LockWrite)) {
+		t.Fatal("同一个owner的锁不应该和自己冲突")
+	}
+	// flock和POSIX锁互不影响
+	fl := fileLock{owner: 4, flock: true, start: 0, end: ^uint64(0), typ: fuse.LockWrite}
+	if _, ok := s.conflict(fl); ok {
+		t.Fatal("flock锁不应该和POSIX锁冲突")
+	}
+}
+
+func TestLockSplit(t *testing.T) {
+	var s lockState
+	s.set(posixLock(1, 0, 99, fuse.LockWrite))
+	// 解锁中间一段，原来的锁拆成两段
+	s.remove(1, false, 40, 59)
+	got := lockRanges(&s, 1)
+	if len(got) != 2 || got[0] != [2]uint64{0, 39} || got[1] != [2]uint64{60, 99} {
+		t.Fatalf("拆开后的锁 = %v", got)
+	}
+	// 在中间加读锁：替换掉原来的部分
+	s.set(posixLock(1, 30, 69, fuse.LockRead))
+	got = lockRanges(&s, 1)
+	if len(got) != 3 || got[0] != [2]uint64{0, 29} || got[1] != [2]uint64{30, 69} || got[2] != [2]uint64{70, 99} {
+		t.Fatalf("替换后的锁 = %v", got)
+	}
+	// 别人可以在读锁的范围里加读锁，不能在写锁的范围里加
+	if !s.set(posixLock(2, 35, 40, fuse.LockRead)) || s.set(posixLock(2, 20, 20, fuse.LockRead)) {
+		t.Fatal("替换后的锁类型不对")
+	}
+	// 解锁整个文件
+	s.remove(1, false, 0, ^uint64(0))
+	if got := lockRanges(&s, 1); len(got) != 0 {
+		t.Fatalf("全部解锁后还有锁 %v", got)
+	}
+}
+
+func TestLockWakeup(t *testing.T) {
+	var s lockState
+	s.set(posixLock(1, 0, 9, fuse.LockWrite))
+	changed := s.wait()
+	// 没有释放锁的操作不唤醒
+	s.remove(2, false, 0, 9)
+	select {
+	case <-changed:
+		t.Fatal("没有锁被释放，不应该唤醒")
+	default:
+	}
+	s.remove(1, false, 5, 5)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("释放锁后应该唤醒等待的请求")
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"time"
 )
 
 // 存放压缩文件的后端目录
@@ -19,26 +21,47 @@ var Mountpoint string
 
 // 帮助信息
 const HELP_INFO = `
-支持的压缩方式有：lzw,flate1,flate9,gzip,zlib。
+支持的压缩方式有：lzw,flate1,flate9,flate,gzip,zlib,zstd。除了lzw、flate1、flate9，都可以用“名字:级别”指定压缩级别，例如zstd:9。
 	lzw: lzw的方式压缩
 	flate1: flate的方式，最快速度
 	flate9: flate的方式，最高压缩率
-	gzip: gzip的方式，最高压缩率（待测试）
-	zlib: zlib的方式，最高压缩率（待测试）
+	flate: flate的方式，级别1-9，默认6
+	gzip: gzip的方式，级别1-9，默认9
+	zlib: zlib的方式，级别1-9，默认9
+	zstd: zstd的方式，级别1-22，默认3，速度快、压缩率高
 
-注意：一旦backend里面有文件，下次重新挂载的时候，压缩方式不能修改！
+每个压缩文件的文件头里记录了自己的压缩方式，修改压缩方式后重新挂载，已有的文件仍然可以读取，修改后以新的压缩方式写回。
+用 convert 命令可以把所有文件转换成新的压缩方式，或者挂载时加上 -migrate 在后台转换。
+旧版本写的（没有文件头的）文件用 -legacy-codec 指定压缩方式：挂载时默认和 -codec 相同，export、fsck等离线命令没有 -codec，必须指定。
+
+每个数据块都有校验和，数据损坏时读取返回EIO。用 scrub 命令可以马上校验整个backend，或者挂载时加上 -scrub-interval 在后台定期巡检。
+压缩方式后面加上“,parity=百分比”（例如zstd:9,parity=10）会额外保存这个比例的纠错数据，少量损坏在读取时自动修复，巡检时写回磁盘。
 `
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "  %s BackendDir Mountpoint CompressType\n", os.Args[0]) // BackendDir 和 Mountpoint 末尾有无斜杠都可
-	fmt.Fprintf(os.Stderr, "例子：  %s /tmp/backend /mnt lzw\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options] [args]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] BackendDir Mountpoint CompressType   (legacy form / 旧的用法)\n", os.Args[0]) // BackendDir 和 Mountpoint 末尾有无斜杠都可
+	fmt.Fprintf(os.Stderr, "例子：  %s mount -codec lzw -cache-dir /dev/shm -cache-size 1G /tmp/backend /mnt\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nCommands / 命令：\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n  %-8s %s\n", cmd.name, cmd.summary, "", cmd.summaryZh)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun \"%s <command> -h\" for details. 运行 \"%s <命令> -h\" 查看详细说明。\n", os.Args[0], os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nOptions of the legacy form (same as mount) / 旧用法的选项（和mount相同）：\n")
+	flag.PrintDefaults()
 	fmt.Fprintf(os.Stderr, HELP_INFO)
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd := findCommand(os.Args[1]); cmd != nil {
+			os.Exit(cmd.run(cmd, os.Args[2:]))
+		}
+	}
 
+	// 旧的用法：compressfs [选项] BackendDir Mountpoint CompressType
 	flag.Usage = usage
+	check := addMountFlags(flag.CommandLine)
 	flag.Parse()
 
 	if flag.NArg() < 3 {
@@ -48,14 +71,8 @@ func main() {
 	BackendDir = flag.Arg(0)
 	Mountpoint = flag.Arg(1)
 	CompressType = flag.Arg(2)
-	switch CompressType {
-	case "lzw":
-	case "flate1":
-	case "flate9":
-	case "gzip":
-	case "zlib":
-	default:
-		fmt.Println("压缩参数错误！")
+	if err := check(); err != nil {
+		fmt.Println(err)
 		usage()
 		os.Exit(2)
 	}
@@ -64,3 +81,93 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// 同时带英文和中文的帮助
+func help(en, zh string) string {
+	return en + "\n" + zh
+}
+
+// 注册离线命令（export、convert、fsck等）的-legacy-codec选项，返回的函数在解析完参数后检查参数并设置LegacyCodec。
+// 和挂载时一样默认为空，这些命令没有-codec，所以读取旧格式的文件时必须指定
+func addLegacyCodecFlag(fs *flag.FlagSet) func() error {
+	legacy := fs.String("legacy-codec", "", help("codec of files written by old versions without a header; required to read such files, since there is no -codec to fall back to", "旧版本写的（没有文件头的）压缩文件的压缩方式。没有-codec可以参照，所以读取这种文件时必须指定"))
+	return func() error {
+		if *legacy != "" && !validCodec(*legacy) {
+			return fmt.Errorf("压缩参数错误！%q", *legacy)
+		}
+		LegacyCodec = *legacy
+		return nil
+	}
+}
+
+// 注册挂载相关的选项，返回的函数在解析完参数后检查参数并设置对应的全局变量
+func addMountFlags(fs *flag.FlagSet) func() error {
+	fs.StringVar(&CacheDir, "cache-dir", "", help("directory for decompressed working copies, e.g. a tmpfs or local SSD (default: system temp dir)", "存放解压后文件的缓存目录，例如tmpfs或本地SSD（默认为系统临时目录）"))
+	cacheSize := fs.String("cache-size", "0", help("size limit of the decompressed cache, with optional K/M/G/T suffix, 0 means unlimited; a file bigger than this cannot be opened (ENOSPC)", "解压缓存的大小上限，可以带K/M/G/T单位，0表示不限制。解压后比这个还大的文件打不开（ENOSPC）"))
+	fs.DurationVar(&CacheTTL, "cache-ttl", 10*time.Minute, help("drop decompressed copies not accessed for this long, 0 means never", "解压缓存的过期时间，超过这个时间没有访问的文件会从缓存中删除，0表示不过期"))
+	fs.DurationVar(&WritebackDelay, "writeback-delay", 0, help("recompress in the background after a file has been idle this long, 0 means on close", "文件关闭后等待多久没有修改再在后台压缩，0表示关闭时马上压缩"))
+	fs.IntVar(&WritebackWorkers, "writeback-workers", 2, help("number of background recompression workers", "后台压缩的并发数"))
+	fs.BoolVar(&KernelWritebackCache, "writeback-cache", false, help("enable the kernel writeback cache so small writes are merged in the kernel", "开启内核的写回缓存，小块写入先在内核里合并"))
+	maxReadahead := fs.String("max-readahead", "128K", help("maximum kernel readahead, with optional K/M suffix, 0 disables readahead", "内核预读的大小上限，可以带K/M单位，0表示不预读"))
+	fs.BoolVar(&AllowOther, "allow-other", false, help("allow other users to access the mount (non-root users need user_allow_other in /etc/fuse.conf)", "允许其他用户访问（非root用户挂载时需要在/etc/fuse.conf里开启user_allow_other）"))
+	fs.BoolVar(&AllowRoot, "allow-root", false, help("allow only the mounting user and root to access the mount", "只允许挂载的用户和root访问"))
+	fs.BoolVar(&ReadOnly, "ro", false, help("mount read-only", "只读挂载"))
+	fs.BoolVar(&ReadOnly, "read-only", false, help("mount read-only, same as -ro; never writes to the backend, so it can be read-only media (NFS export, snapshot)", "只读挂载，同-ro。不会写BackendDir，可以挂载只读介质（NFS导出、快照）"))
+	fs.BoolVar(&DefaultPermissions, "default-permissions", false, help("let the kernel check access against file permissions", "由内核按文件的权限检查访问"))
+	fs.IntVar(&ForceUid, "uid", -1, help("show all files as owned by this user, -1 uses the owner of the compressed file", "所有文件显示为这个用户，-1表示使用压缩文件的用户"))
+	fs.IntVar(&ForceGid, "gid", -1, help("show all files as owned by this group, -1 uses the group of the compressed file", "所有文件显示为这个组，-1表示使用压缩文件的组"))
+	umask := fs.String("umask", "", help("clear these permission bits on all files (octal, e.g. 022), default unchanged", "所有文件的权限去掉这些位（八进制，例如022），默认不修改"))
+	fs.StringVar(&LegacyCodec, "legacy-codec", "", help("codec of files written by old versions without a header (default: same as the codec); -migrate only converts such files when it is set", "旧版本写的（没有文件头的）压缩文件的压缩方式（默认和压缩方式相同）。只有设置了才用-migrate转换这种文件"))
+	fs.BoolVar(&Migrate, "migrate", false, help("convert files written with another codec to the codec in the background: files that are read right away, the rest while idle", "在后台把其他压缩方式的文件转换成当前的压缩方式：读过的文件马上转换，其他文件在空闲时转换"))
+	fs.DurationVar(&MigrateIdle, "migrate-idle", 5*time.Second, help("with -migrate, how long without requests counts as idle", "使用-migrate时，多久没有请求算作空闲"))
+	fs.DurationVar(&ScrubInterval, "scrub-interval", 0, help("verify the whole backend in the background this long after the previous pass finished, e.g. 168h, 0 disables it", "在后台定期巡检整个backend，上一遍检查完后过多久再检查一遍，例如168h，0表示不巡检"))
+	scrubRate := fs.String("scrub-rate", "8M", help("maximum read rate of the background scrub per second, with optional K/M/G suffix, 0 means unlimited", "后台巡检的读取速度上限（每秒），可以带K/M/G单位，0表示不限制"))
+	fs.StringVar(&FSName, "fsname", "compressfs", help("filesystem name shown by mount and df", "在mount、df里显示的文件系统名字"))
+
+	return func() error {
+		codec, err := canonicalCodec(CompressType)
+		if err != nil {
+			return fmt.Errorf("压缩参数错误！%v", err)
+		}
+		CompressType = codec
+		if LegacyCodec != "" && !validCodec(LegacyCodec) {
+			return fmt.Errorf("压缩参数错误！%q", LegacyCodec)
+		}
+		for _, dir := range []string{BackendDir, Mountpoint} {
+			fi, err := os.Stat(dir)
+			if err != nil {
+				return fmt.Errorf("目录错误！%v", err)
+			}
+			if !fi.IsDir() {
+				return fmt.Errorf("%s不是目录！", dir)
+			}
+		}
+		size, err := parseSize(*cacheSize)
+		if err != nil {
+			return fmt.Errorf("缓存大小参数错误！%v", err)
+		}
+		CacheSize = size
+		readahead, err := parseSize(*maxReadahead)
+		if err != nil || readahead > 1<<30 {
+			return fmt.Errorf("预读大小参数错误！%q", *maxReadahead)
+		}
+		MaxReadahead = uint32(readahead)
+		if ScrubRate, err = parseSize(*scrubRate); err != nil {
+			return fmt.Errorf("巡检速度参数错误！%v", err)
+		}
+		if Migrate && ReadOnly {
+			return fmt.Errorf("-migrate和-read-only不能同时使用！")
+		}
+		if AllowOther && AllowRoot {
+			return fmt.Errorf("-allow-other和-allow-root不能同时使用！")
+		}
+		if *umask != "" {
+			m, err := strconv.ParseUint(*umask, 8, 32)
+			if err != nil || m > 0777 {
+				return fmt.Errorf("umask参数错误！%q", *umask)
+			}
+			ForceUmask = int(m)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 在线转换：挂载时在后台把其他压缩方式（包括旧格式）的文件转换成 CompressType。
+// 读过的文件马上转换，其他文件等一段时间没有请求（空闲）时逐个转换
+var Migrate bool
+
+// 多久没有请求算作空闲
+var MigrateIdle time.Duration
+
+// 最后一次FUSE请求的时间（UnixNano）
+var lastRequest atomic.Int64
+
+// 记录收到请求的时间，用于判断是否空闲
+func noteRequest() {
+	lastRequest.Store(time.Now().UnixNano())
+}
+
+type migrator struct {
+	mu       sync.Mutex
+	pending  []*File        // 读过、等待转换的文件
+	queued   map[*File]bool // 已经在pending里或者已经检查过的文件
+	kickChan chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+var mg = migrator{
+	queued:   make(map[*File]bool),
+	kickChan: make(chan struct{}, 1),
+}
+
+// 启动后台转换，没有开启-migrate时不启动
+func (m *migrator) start() {
+	if !Migrate {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.loop()
+}
+
+// 文件被读取（解压）了，尽快转换。调用时需持有f.mu
+func (m *migrator) read(f *File) {
+	if !Migrate {
+		return
+	}
+	m.mu.Lock()
+	if !m.queued[f] {
+		m.queued[f] = true
+		m.pending = append(m.pending, f)
+	}
+	m.mu.Unlock()
+	select {
+	case m.kickChan <- struct{}{}:
+	default:
+	}
+}
+
+// 取出下一个读过的文件
+func (m *migrator) next() *File {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.pending) == 0 {
+		return nil
+	}
+	f := m.pending[0]
+	m.pending = m.pending[1:]
+	return f
+}
+
+// 先转换读过的文件，空闲时再按顺序检查挂载时就有的所有文件
+func (m *migrator) loop() {
+	defer close(m.done)
+	files := allFiles()
+	fmt.Println("[migrate]后台转换为", CompressType, "文件数：", len(files))
+	for i := 0; ; {
+		select {
+		case <-m.stop:
+			return
+		default:
+		}
+		if f := m.next(); f != nil {
+			migrateFile(f)
+			continue
+		}
+		idle := time.Since(time.Unix(0, lastRequest.Load()))
+		if i < len(files) && idle >= MigrateIdle {
+			f := files[i]
+			i++
+			m.mu.Lock()
+			checked := m.queued[f]
+			m.queued[f] = true
+			m.mu.Unlock()
+			if !checked {
+				migrateFile(f)
+			}
+			if i == len(files) {
+				fmt.Println("[migrate]已经检查完所有文件")
+			}
+			continue
+		}
+		wait := time.Second
+		if i < len(files) && MigrateIdle-idle < wait {
+			wait = MigrateIdle - idle
+		}
+		select {
+		case <-m.stop:
+			return
+		case <-m.kickChan:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// 卸载时停止后台转换，等正在转换的文件完成
+func (m *migrator) shutdown() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+}
+
+// 返回目录树里的所有文件
+func allFiles() []*File {
+	treeLock.RLock()
+	defer treeLock.RUnlock()
+	var files []*File
+	var walk func(d *Dir)
+	walk = func(d *Dir) {
+		for _, f := range d.files {
+			files = append(files, f)
+		}
+		for _, sub := range d.directories {
+			walk(sub)
+		}
+	}
+	walk(filesys.root)
+	return files
+}
+
+// 把一个文件转换成 CompressType。转换时不持有锁，替换前再检查文件在这期间没有被修改、删除或者重命名
+func migrateFile(f *File) {
+	treeLock.RLock()
+	path := BackendDir + f.fullPath + f.name
+	treeLock.RUnlock()
+	need, err := needsConvert(path, CompressType)
+	if err != nil || !need {
+		return
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	start := time.Now()
+	tmpPath, err := convertToTemp(path, CompressType, fi)
+	if err != nil {
+		fmt.Println("[ERROR]转换文件失败！", path, err)
+		return
+	}
+	treeLock.RLock()
+	defer treeLock.RUnlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cur, err := os.Stat(path)
+	if f.modified || f.unlinked || BackendDir+f.fullPath+f.name != path ||
+		err != nil || !cur.ModTime().Equal(fi.ModTime()) || cur.Size() != fi.Size() {
+		fmt.Println("[migrate]文件在转换时被修改了，跳过", path)
+		os.Remove(tmpPath)
+		return
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		fmt.Println("[ERROR]转换文件失败！", path, err)
+		os.Remove(tmpPath)
+		return
+	}
+	// 解压后的内容没有变，缓存和内核的页缓存都还有效
+	if !f.backendMtime.IsZero() {
+		f.saveBackendStat()
+	}
+	newFi, _ := os.Stat(path)
+	if newFi != nil {
+		fmt.Println("[migrate]转换为", CompressType, path, formatSize(fi.Size()), "->", formatSize(newFi.Size()), "用时", time.Since(start).Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// 挂载选项
+var (
+	AllowOther         bool   // 允许其他用户访问
+	AllowRoot          bool   // 只允许挂载的用户和root访问
+	ReadOnly           bool   // 只读挂载
+	DefaultPermissions bool   // 由内核按文件的权限检查访问
+	FSName             string // 在mount、df里显示的文件系统名字
+	ForceUid           = -1   // 所有文件显示为这个用户，-1表示使用压缩文件的用户
+	ForceGid           = -1   // 所有文件显示为这个组，-1表示使用压缩文件的组
+	ForceUmask         = -1   // 所有文件的权限去掉这些位，-1表示不修改
+)
+
+// 根据挂载选项生成 fuse.Mount 的参数 https://godoc.org/bazil.org/fuse#MountOption
+func mountOptions() []fuse.MountOption {
+	options := []fuse.MountOption{
+		fuse.FSName(FSName),
+		fuse.Subtype("compressfs"),
+		fuse.LockingFlock(),
+		fuse.LockingPOSIX(),
+		fuse.AsyncRead(),
+		fuse.MaxReadahead(MaxReadahead),
+	}
+	if KernelWritebackCache {
+		options = append(options, fuse.WritebackCache())
+	}
+	// bazil.org/fuse 没有allow_root，用allow_other挂载，再由checkAccess拒绝其他用户
+	if AllowOther || AllowRoot {
+		options = append(options, fuse.AllowOther())
+	}
+	if ReadOnly {
+		options = append(options, fuse.ReadOnly())
+	}
+	if DefaultPermissions {
+		options = append(options, fuse.DefaultPermissions())
+	}
+	return options
+}
+
+// 在context里保存发出请求的用户
+type callerKey struct{}
+
+// 给每个请求的context加上发出请求的用户，作为 fs.Config.WithContext 使用
+func withCaller(ctx context.Context, req fuse.Request) context.Context {
+	noteRequest()
+	return context.WithValue(ctx, callerKey{}, req.Hdr().Uid)
+}
+
+// 开启allow_root时，只允许挂载的用户和root访问，其他用户返回 EACCES
+func checkAccess(ctx context.Context) error {
+	if !AllowRoot {
+		return nil
+	}
+	uid, ok := ctx.Value(callerKey{}).(uint32)
+	if !ok || uid == 0 || uid == uint32(os.Getuid()) {
+		return nil
+	}
+	return fuse.Errno(syscall.EACCES)
+}
+
+// 按挂载选项修改文件属性里的用户、组和权限
+func overrideAttr(a *fuse.Attr) {
+	if ForceUid >= 0 {
+		a.Uid = uint32(ForceUid)
+	}
+	if ForceGid >= 0 {
+		a.Gid = uint32(ForceGid)
+	}
+	if ForceUmask >= 0 {
+		a.Mode &^= os.FileMode(ForceUmask) & os.ModePerm
+	}
+}
+
+// 从压缩文件（或目录、特殊文件）的属性里取出用户和组
+func setOwner(a *fuse.Attr, fi os.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		a.Uid = st.Uid
+		a.Gid = st.Gid
+	}
+}
+
+// 只读挂载时，修改文件系统的操作返回 EROFS。内核在只读挂载时一般已经拒绝了，这里再检查一次，保证不会写BackendDir
+func checkWritable() error {
+	if ReadOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// 纠错数据（压缩设置里的parity=N%）。压缩数据错了一位，这一块就解压不出来了，所以设置了parity时，
+// 记录按组（压缩后约parityGroupSize）写入，每组前面有一条校验记录：
+//
+//	'P' [组的长度(4) 数据分片数K(1) 校验分片数M(1) 分片大小(4) CRC32C(4)]×2 [每个分片的CRC32C(4*(K+M)) CRC32C(4)]×2 校验分片(M*分片大小)
+//
+// 后面紧跟着这一组的记录。组的内容切成K个分片（最后一个补0），用Reed-Solomon算出M个校验分片，M = ceil(K*N/100)。
+// 读取时CRC不对的分片当作丢失，坏的分片不超过M个就能恢复；校验记录本身没有纠错数据，所以存两份。
+// 结束记录放在最后一组里，文件最后再放一份给 decodedSize 用，这一份坏了也能修好。
+// 分片至少4K，小文件的分片少，实际的开销会比N%大
+const (
+	recordParity    = 'P'
+	parityGroupSize = 4 << 20
+	parityMaxShards = 100  // K的上限
+	parityMinShard  = 4096 // 分片的最小长度
+)
+
+// 挂载以来读取时用纠错数据修复的次数
+var ParityRepairs atomic.Int64
+
+// 用纠错数据修复好的一段压缩文件：写回off处就修好了磁盘上的文件
+type parityFix struct {
+	off  int64
+	data []byte
+}
+
+// 算出一组记录的纠错数据，和这组记录一起写入w
+func writeParityGroup(w io.Writer, group []byte, parity int) error {
+	k := (len(group) + parityMinShard - 1) / parityMinShard
+	if k > parityMaxShards {
+		k = parityMaxShards
+	}
+	m := (k*parity + 99) / 100
+	shardSize := (len(group) + k - 1) / k
+	enc, err := reedsolomon.New(k, m)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, (k+m)*shardSize)
+	copy(buf, group)
+	shards := make([][]byte, k+m)
+	for i := range shards {
+		shards[i] = buf[i*shardSize : (i+1)*shardSize]
+	}
+	if err := enc.Encode(shards); err != nil {
+		return err
+	}
+	var fixed, table []byte
+	fixed = binary.LittleEndian.AppendUint32(fixed, uint32(len(group)))
+	fixed = append(fixed, byte(k), byte(m))
+	fixed = binary.LittleEndian.AppendUint32(fixed, uint32(shardSize))
+	fixed = binary.LittleEndian.AppendUint32(fixed, crc32c(fixed))
+	for _, shard := range shards {
+		table = binary.LittleEndian.AppendUint32(table, crc32c(shard))
+	}
+	table = binary.LittleEndian.AppendUint32(table, crc32c(table))
+	hdr := []byte{recordParity}
+	hdr = append(append(hdr, fixed...), fixed...)
+	hdr = append(append(hdr, table...), table...)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := w.Write(buf[k*shardSize:]); err != nil {
+		return err
+	}
+	_, err = w.Write(group)
+	return err
+}
+
+func crc32c(p []byte) uint32 {
+	return blockChecksum(nil, p)
+}
+
+// 读取按组保存的记录：每次读入一组，校验每个分片，坏了的用纠错数据修复，再把这一组的记录交给blockReader。
+// 组后面的结束记录原样读出
+type parityReader struct {
+	r       *bufio.Reader
+	off     int64  // 下一个字节在压缩文件里的位置
+	buf     []byte // 当前这一组（已经修复）
+	pos     int
+	tail    bool        // 已经读完所有的组
+	tailOff int64       // 文件最后的结束记录的位置
+	fixes   []parityFix // 修复好的分片
+}
+
+func (p *parityReader) Read(b []byte) (int, error) {
+	for p.pos == len(p.buf) && !p.tail {
+		if err := p.nextGroup(); err != nil {
+			return 0, err
+		}
+	}
+	if p.pos < len(p.buf) {
+		n := copy(b, p.buf[p.pos:])
+		p.pos += n
+		return n, nil
+	}
+	n, err := p.r.Read(b)
+	p.off += int64(n)
+	return n, err
+}
+
+// 读入下一组。后面只剩不到10个字节的话，是文件最后的结束记录（或者文件被截断了），所有的组都读完了。
+// 不看记录的类型，类型那个字节坏了也能读
+func (p *parityReader) nextGroup() error {
+	p.buf, p.pos = p.buf[:0], 0
+	head, _ := p.r.Peek(10)
+	if len(head) < 10 {
+		p.tail = true
+		p.tailOff = p.off
+		return nil
+	}
+	start := p.off
+	if head[0] != recordParity {
+		p.fixes = append(p.fixes, parityFix{off: start, data: []byte{recordParity}})
+	}
+	p.r.Discard(1)
+	fixed, err := p.readCopies(start+1, 10)
+	if err != nil {
+		return err
+	}
+	groupLen := int(binary.LittleEndian.Uint32(fixed[0:]))
+	k, m := int(fixed[4]), int(fixed[5])
+	shardSize := int(binary.LittleEndian.Uint32(fixed[6:]))
+	if k == 0 || m == 0 || groupLen <= (k-1)*shardSize || groupLen > k*shardSize || groupLen > 64<<20 {
+		return errCorrupt
+	}
+	table, err := p.readCopies(start+1+2*(10+4), 4*(k+m))
+	if err != nil {
+		return err
+	}
+	p.off += 1 + 2*(10+4) + 2*int64(len(table)+4)
+	parityOff := p.off
+
+	// 先读校验分片再读这一组的记录，数据分片的最后一个补0
+	buf := make([]byte, (k+m)*shardSize)
+	parity := buf[k*shardSize:]
+	if _, err := io.ReadFull(p.r, parity); err != nil {
+		return readError(err)
+	}
+	if _, err := io.ReadFull(p.r, buf[:groupLen]); err != nil {
+		return readError(err)
+	}
+	groupOff := parityOff + int64(len(parity))
+	p.off = groupOff + int64(groupLen)
+
+	shards := make([][]byte, k+m)
+	var bad []int
+	for i := range shards {
+		shards[i] = buf[i*shardSize : (i+1)*shardSize]
+		if crc32c(shards[i]) != binary.LittleEndian.Uint32(table[4*i:]) {
+			shards[i] = shards[i][:0]
+			bad = append(bad, i)
+		}
+	}
+	if len(bad) > 0 {
+		p.repair(shards, bad, k, m, shardSize, groupLen, groupOff, parityOff)
+	}
+	for i := 0; i < k; i++ {
+		p.buf = append(p.buf, shards[i]...)
+	}
+	p.buf = p.buf[:groupLen]
+	return nil
+}
+
+// 读取off处存了两份的字段：每份是n个字节加上CRC32C，返回CRC对的那一份，另一份坏了的话记下修复
+func (p *parityReader) readCopies(off int64, n int) ([]byte, error) {
+	buf := make([]byte, 2*(n+4))
+	if _, err := io.ReadFull(p.r, buf); err != nil {
+		return nil, readError(err)
+	}
+	copies := [][]byte{buf[:n+4], buf[n+4:]}
+	for i, c := range copies {
+		if crc32c(c[:n]) != binary.LittleEndian.Uint32(c[n:]) {
+			continue
+		}
+		if other := copies[1-i]; !bytes.Equal(c, other) {
+			p.fixes = append(p.fixes, parityFix{off: off + int64((1-i)*(n+4)), data: c})
+		}
+		return c[:n], nil
+	}
+	return nil, errCorrupt
+}
+
+// 修复坏了的分片（shards[i]长度为0）。坏的太多的话保留原来的数据，由每块的校验和发现哪一块坏了
+func (p *parityReader) repair(shards [][]byte, bad []int, k, m, shardSize, groupLen int, groupOff, parityOff int64) {
+	enc, err := reedsolomon.New(k, m)
+	if err == nil {
+		err = enc.Reconstruct(shards)
+	}
+	if err != nil {
+		for _, i := range bad {
+			shards[i] = shards[i][:shardSize]
+		}
+		return
+	}
+	for _, i := range bad {
+		fix := parityFix{off: groupOff + int64(i*shardSize), data: shards[i]}
+		if i >= k {
+			fix.off = parityOff + int64((i-k)*shardSize)
+		} else if end := (i + 1) * shardSize; end > groupLen {
+			// 最后一个数据分片补的0不在文件里
+			fix.data = fix.data[:groupLen-i*shardSize]
+		}
+		p.fixes = append(p.fixes, fix)
+	}
+}
+
+// 把修复好的分片写回压缩文件f（path）。修复不算修改文件，修改时间保持不变
+func applyParityFixes(f *os.File, path string, fixes []parityFix) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	for _, fix := range fixes {
+		if _, err := f.WriteAt(fix.data, fix.off); err != nil {
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	// 检查时文件可能已经被替换了，这时修的是旧的文件，不用恢复修改时间
+	if cur, err := os.Stat(path); err == nil && os.SameFile(fi, cur) {
+		return os.Chtimes(path, time.Now(), fi.ModTime())
+	}
+	return nil
+}
+
+// 修复的字节数
+func fixedBytes(fixes []parityFix) int64 {
+	var n int64
+	for _, fix := range fixes {
+		n += int64(len(fix.data))
+	}
+	return n
+}
+
+// 显示修复的情况，例如“3处（12.0 KiB）”
+func formatFixes(fixes []parityFix) string {
+	return fmt.Sprintf("%d处（%s）", len(fixes), formatSize(fixedBytes(fixes)))
+}
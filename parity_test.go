@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 解压enc（损坏的压缩文件），数据应该和data一样，并且有需要写回的修复
+func decodeRepaired(t *testing.T, enc, data []byte) []parityFix {
+	t.Helper()
+	var out bytes.Buffer
+	n, fixes, err := decodeFileFixes(bytes.NewReader(enc), &out)
+	if err != nil {
+		t.Fatalf("decodeFileFixes: %v", err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("修复后的数据不一致")
+	}
+	if len(fixes) == 0 {
+		t.Fatal("没有记下要写回的修复")
+	}
+	return fixes
+}
+
+// 把修复写回磁盘上的文件，写回后应该和原来的压缩文件完全一样
+func checkApplyFixes(t *testing.T, damaged, orig []byte, fixes []parityFix) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(path, damaged, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := applyParityFixes(f, path, fixes); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, orig) {
+		t.Fatal("写回修复后和原来的压缩文件不一样")
+	}
+}
+
+func TestParityRepairFlippedByte(t *testing.T) {
+	data := testData(t)
+	orig := encodeBytes(t, data, "zstd,parity=10%")
+	spec, _ := canonicalCodec("zstd,parity=10%")
+	h := len(formatMagic) + 7 + len(spec) // 第一组的校验记录
+	// 组里的数据、校验分片、记录的类型、两份固定字段、两份CRC表
+	for _, off := range []int{len(orig) / 2, len(orig) / 3, h + 200, h, h + 5, h + 1 + 14 + 3, h + 1 + 28 + 2, h + 1 + 28 + 420} {
+		enc := append([]byte(nil), orig...)
+		enc[off] ^= 0x01
+		fixes := decodeRepaired(t, enc, data)
+		checkApplyFixes(t, enc, orig, fixes)
+	}
+}
+
+func TestParityRepairTail(t *testing.T) {
+	data := testData(t)
+	orig := encodeBytes(t, data, "zstd,parity=10%")
+	// 文件最后的结束记录坏了
+	enc := append([]byte(nil), orig...)
+	enc[len(enc)-1] ^= 0x80
+	fixes := decodeRepaired(t, enc, data)
+	checkApplyFixes(t, enc, orig, fixes)
+	// 文件最后的结束记录被截断了
+	enc = orig[:len(orig)-4]
+	fixes = decodeRepaired(t, enc, data)
+	checkApplyFixes(t, enc, orig, fixes)
+}
+
+func TestParityNoDamage(t *testing.T) {
+	data := testData(t)
+	enc := encodeBytes(t, data, "zstd,parity=10%")
+	_, fixes, err := decodeFileFixes(bytes.NewReader(enc), &bytes.Buffer{})
+	if err != nil || len(fixes) != 0 {
+		t.Fatalf("decodeFileFixes = %d处修复, %v", len(fixes), err)
+	}
+}
+
+func TestParityTooMuchDamage(t *testing.T) {
+	data := testData(t)
+	enc := encodeBytes(t, data, "zstd,parity=1%")
+	// 坏的分片比校验分片多，修不了，由数据块的校验和发现
+	for i := len(enc) / 4; i < len(enc)*3/4; i += 8192 {
+		enc[i] ^= 0x01
+	}
+	_, err := decodeFile(bytes.NewReader(enc), &bytes.Buffer{})
+	if !errors.Is(err, errChecksum) && !errors.Is(err, errBadBlock) {
+		t.Fatalf("decodeFile err = %v, want errChecksum", err)
+	}
+}
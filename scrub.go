@@ -0,0 +1,563 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 巡检（scrub）：把backend里的每个文件完整解压一遍，校验每个数据块的校验和，在用户读到之前发现磁盘上
+// 悄悄损坏的数据，有纠错数据（parity）的文件顺便把修复好的数据写回去。
+// 挂载时可以在后台定期巡检（-scrub-interval），也可以用scrub命令马上检查一遍。
+// 结果记录在 BACKEND/.compressfs/scrub/ 里：status.json是最近一次巡检的进度，history.log每行一条记录（JSON）
+
+// 后台巡检的间隔：上一遍检查完后过多久再检查一遍，0表示不在后台巡检
+var ScrubInterval time.Duration
+
+// 后台巡检读取压缩文件的速度上限（字节/秒），0表示不限制
+var ScrubRate int64
+
+// 巡检被停止（卸载或者中断）
+var errScrubStopped = errors.New("巡检已停止")
+
+// 巡检的进度，保存在status.json
+type scrubStatus struct {
+	State      string    `json:"state"` // running、done、interrupted
+	Started    time.Time `json:"started"`
+	Updated    time.Time `json:"updated"` // 最后一次更新的时间，state为done时就是完成的时间
+	TotalFiles int64     `json:"total_files"`
+	TotalBytes int64     `json:"total_bytes"` // 压缩后的大小
+	Files      int64     `json:"files"`       // 已经检查的文件数
+	Bytes      int64     `json:"bytes"`
+	Unchecked  int64     `json:"unchecked"` // 没有校验和的文件数（旧版本写的），只能检查能不能解压
+	Repaired   int64     `json:"repaired"`  // 用纠错数据修复的文件数
+	Problems   int64     `json:"problems"`
+	Last       string    `json:"last,omitempty"` // 后台巡检最后检查完的文件（相对路径），中断后从它后面继续
+}
+
+// history.log里的一条记录：发现的问题（problem）、用纠错数据修复的文件（repaired，只读时为repairable）
+// 或者一遍巡检的结果（done、interrupted）
+type scrubEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Path     string    `json:"path,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Offset   int64     `json:"offset,omitempty"`
+	Files    int64     `json:"files,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Problems int64     `json:"problems,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+}
+
+// 记录巡检的结果。dir为空时不记录（只读挂载）
+type scrubLog struct {
+	dir    string
+	mu     sync.Mutex
+	status scrubStatus
+}
+
+func newScrubLog(backend string, write bool) *scrubLog {
+	l := &scrubLog{}
+	if write {
+		l.dir = filepath.Join(backend, metaDirName, "scrub")
+	}
+	return l
+}
+
+// 读取上一次巡检的进度，没有记录时返回空的状态
+func loadScrubStatus(backend string) scrubStatus {
+	var st scrubStatus
+	if data, err := os.ReadFile(filepath.Join(backend, metaDirName, "scrub", "status.json")); err == nil {
+		json.Unmarshal(data, &st)
+	}
+	return st
+}
+
+// 开始一遍巡检
+func (l *scrubLog) begin(totalFiles, totalBytes int64) {
+	l.mu.Lock()
+	now := time.Now()
+	l.status = scrubStatus{State: "running", Started: now, Updated: now, TotalFiles: totalFiles, TotalBytes: totalBytes}
+	l.mu.Unlock()
+	l.save()
+}
+
+// 检查完一个文件，记录修复和发现的问题
+func (l *scrubLog) file(rel string, size int64, res scrubResult) {
+	l.mu.Lock()
+	l.status.Files++
+	l.status.Bytes += size
+	if !res.checked {
+		l.status.Unchecked++
+	}
+	if res.repaired {
+		l.status.Repaired++
+	}
+	if res.err != nil {
+		l.status.Problems++
+	}
+	l.mu.Unlock()
+	if len(res.fixes) > 0 {
+		event := "repairable"
+		if res.repaired {
+			event = "repaired"
+		}
+		l.append(scrubEvent{Time: time.Now(), Event: event, Path: rel, Bytes: fixedBytes(res.fixes)})
+	}
+	if res.err != nil {
+		l.append(scrubEvent{Time: time.Now(), Event: "problem", Path: rel, Error: res.err.Error(), Offset: res.off})
+	}
+}
+
+// 结束一遍巡检，state为done或者interrupted
+func (l *scrubLog) end(state string) scrubStatus {
+	l.mu.Lock()
+	l.status.State = state
+	st := l.status
+	l.mu.Unlock()
+	l.save()
+	l.append(scrubEvent{Time: time.Now(), Event: state, Files: st.Files, Bytes: st.Bytes, Problems: st.Problems,
+		Duration: time.Since(st.Started).Round(time.Second).String()})
+	return st
+}
+
+// 把进度写入status.json：先写临时文件再rename，读的时候不会读到写了一半的文件
+func (l *scrubLog) save() {
+	l.mu.Lock()
+	l.status.Updated = time.Now()
+	data, _ := json.MarshalIndent(l.status, "", "  ")
+	l.mu.Unlock()
+	if l.dir == "" {
+		return
+	}
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		fmt.Println("[ERROR]记录巡检结果失败！", err)
+		return
+	}
+	tmpPath, err := createTemp(l.dir, nil, false, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(l.dir, "status.json"))
+	}
+	if err != nil {
+		fmt.Println("[ERROR]记录巡检结果失败！", err)
+	}
+}
+
+// 在history.log后面追加一条记录
+func (l *scrubLog) append(e scrubEvent) {
+	if l.dir == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		fmt.Println("[ERROR]记录巡检结果失败！", err)
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(l.dir, "history.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		fmt.Println("[ERROR]记录巡检结果失败！", err)
+		return
+	}
+	defer f.Close()
+	data, _ := json.Marshal(e)
+	f.Write(append(data, '\n'))
+}
+
+// 巡检要检查的一个文件
+type scrubFile struct {
+	path string
+	size int64
+}
+
+// 扫描backend里要巡检的压缩文件。临时文件不是压缩文件，由fsck处理
+func scanScrubFiles(backend string) ([]scrubFile, int64, error) {
+	var files []scrubFile
+	var total int64
+	err := filepath.WalkDir(backend, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]", err)
+			return nil
+		}
+		if d.IsDir() && isMetaDir(backend, path) {
+			return fs.SkipDir
+		}
+		if !d.Type().IsRegular() || isTempName(d.Name()) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, scrubFile{path, fi.Size()})
+		total += fi.Size()
+		return nil
+	})
+	return files, total, err
+}
+
+// 限制读取速度，多个goroutine共用
+type throttle struct {
+	mu   sync.Mutex
+	rate int64     // 字节/秒，0表示不限制
+	next time.Time // 按速度上限，下一次读取最早可以开始的时间
+}
+
+// 读了n字节后调用，读得太快的话等待。stop关闭时返回false（不限速、不用等待时也检查）
+func (t *throttle) wait(n int, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+	if t == nil || t.rate <= 0 {
+		return true
+	}
+	t.mu.Lock()
+	// 空闲过的时间最多攒1秒，睡过头的部分也算在里面，否则每次都睡过头会比速度上限慢很多
+	now := time.Now()
+	if earliest := now.Add(-time.Second); t.next.Before(earliest) {
+		t.next = earliest
+	}
+	t.next = t.next.Add(time.Duration(int64(n) * int64(time.Second) / t.rate))
+	delay := t.next.Sub(now)
+	t.mu.Unlock()
+	if delay < 10*time.Millisecond {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// 限速读取压缩文件
+type throttledReader struct {
+	r    io.Reader
+	t    *throttle
+	stop <-chan struct{}
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > 256<<10 {
+		p = p[:256<<10]
+	}
+	n, err := r.r.Read(p)
+	if !r.t.wait(n, r.stop) {
+		return n, errScrubStopped
+	}
+	return n, err
+}
+
+// 检查一个文件的结果
+type scrubResult struct {
+	checked  bool        // 文件有校验和
+	fixes    []parityFix // 用纠错数据修复好的部分
+	repaired bool        // 已经写回了磁盘上的文件
+	off      int64       // 出错的位置（解压后的偏移）
+	err      error
+}
+
+// 检查一个压缩文件：完整解压一遍，校验每个数据块的校验和。有纠错数据的文件坏了一点的话，
+// repair为true时把修复好的部分写回去（文件不能写的话只报告）
+func scrubOne(path string, t *throttle, stop <-chan struct{}, repair bool) (res scrubResult) {
+	h, err := readFileHeader(path)
+	if err != nil {
+		res.err = err
+		return
+	}
+	res.checked = h != nil && h.flags&flagChecksum != 0
+	repair = repair && h != nil && h.flags&flagParity != 0
+	var f *os.File
+	if repair {
+		if f, err = os.OpenFile(path, os.O_RDWR, 0); err != nil {
+			repair = false
+		}
+	}
+	if !repair {
+		if f, err = os.Open(path); err != nil {
+			res.err = err
+			return
+		}
+	}
+	defer f.Close()
+	res.off, res.fixes, res.err = decodeFileFixes(&throttledReader{r: f, t: t, stop: stop}, io.Discard)
+	if repair && len(res.fixes) > 0 {
+		if err := applyParityFixes(f, path, res.fixes); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]写回修复好的数据失败！", path, err)
+		} else {
+			res.repaired = true
+		}
+	}
+	return
+}
+
+// 后台巡检
+type scrubber struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+var scrub scrubber
+
+// 启动后台巡检，没有设置-scrub-interval时不启动
+func (s *scrubber) start() {
+	if ScrubInterval <= 0 {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.loop()
+}
+
+// 上一遍检查完ScrubInterval之后再检查一遍。上一遍没有检查完（卸载了）的话马上从中断的地方继续
+func (s *scrubber) loop() {
+	defer close(s.done)
+	backend := filepath.Clean(BackendDir)
+	for {
+		last := loadScrubStatus(backend)
+		var wait time.Duration
+		var resume string
+		if last.State == "done" {
+			wait = time.Until(last.Updated.Add(ScrubInterval))
+		} else if last.State != "" {
+			resume = last.Last
+		}
+		if wait > 0 {
+			fmt.Println("[scrub]下一次巡检：", time.Now().Add(wait).Format("2006-01-02 15:04:05"))
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(wait):
+		}
+		if !s.pass(backend, resume, last) {
+			return
+		}
+		// 只读挂载时不能记录结果，只好等一个间隔
+		if ReadOnly {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(ScrubInterval):
+			}
+		}
+	}
+}
+
+// 检查一遍backend，从resume（相对路径）后面的文件开始（接着上一遍last），resume为空时从头开始。
+// 两次挂载之间backend里的文件可能增加或者删除了，所以按路径而不是按序号继续。被停止的话返回false
+func (s *scrubber) pass(backend string, resume string, last scrubStatus) bool {
+	files, total, err := scanScrubFiles(backend)
+	if err != nil {
+		fmt.Println("[ERROR]巡检扫描backend失败！", err)
+	}
+	l := newScrubLog(backend, !ReadOnly)
+	l.begin(int64(len(files)), total)
+	// 扫描的结果是按WalkDir的顺序排好的
+	next := sort.Search(len(files), func(i int) bool {
+		rel, _ := filepath.Rel(backend, files[i].path)
+		return walkLess(resume, rel)
+	})
+	if resume != "" && next < len(files) {
+		// 接着上一遍：保留上一遍的开始时间和已经检查的部分
+		l.mu.Lock()
+		l.status.Started = last.Started
+		l.status.Files, l.status.Bytes, l.status.Unchecked, l.status.Repaired, l.status.Problems, l.status.Last =
+			last.Files, last.Bytes, last.Unchecked, last.Repaired, last.Problems, resume
+		l.mu.Unlock()
+		fmt.Println("[scrub]继续上一次的巡检，从", resume, "后面的文件开始")
+		files = files[next:]
+	} else {
+		fmt.Println("[scrub]开始巡检，文件数：", len(files), "大小：", formatSize(total), "速度上限：", formatRate(ScrubRate))
+	}
+	t := &throttle{rate: ScrubRate}
+	lastSave := time.Now()
+	for _, sf := range files {
+		// 每个文件开始前也检查，文件很小（或者都是空洞）时读取中间可能一次都不检查。
+		// Last还是上一个检查完的文件，下次从这个文件开始
+		stopped := s.stopped()
+		var res scrubResult
+		if !stopped {
+			res = scrubOne(sf.path, t, s.stop, !ReadOnly)
+			stopped = res.err != nil && s.stopped()
+		}
+		if stopped {
+			l.end("interrupted")
+			fmt.Println("[scrub]巡检已暂停，下次挂载时继续")
+			return false
+		}
+		// 检查时被删除或者替换了，不算问题
+		if errors.Is(res.err, os.ErrNotExist) {
+			res.err = nil
+		}
+		rel, _ := filepath.Rel(backend, sf.path)
+		if res.repaired {
+			fmt.Println("[scrub]用纠错数据修复了", sf.path, formatFixes(res.fixes))
+		}
+		if res.err != nil {
+			fmt.Println("[ERROR]巡检发现损坏的文件！", sf.path, res.err, "偏移", res.off)
+		}
+		l.file(rel, sf.size, res)
+		l.mu.Lock()
+		l.status.Last = rel
+		l.mu.Unlock()
+		if time.Since(lastSave) >= time.Minute {
+			lastSave = time.Now()
+			l.save()
+			l.mu.Lock()
+			fmt.Printf("[scrub]进度：%d/%d个文件，%s/%s\n", l.status.Files, l.status.TotalFiles, formatSize(l.status.Bytes), formatSize(l.status.TotalBytes))
+			l.mu.Unlock()
+		}
+	}
+	st := l.end("done")
+	fmt.Printf("[scrub]巡检完成：%d个文件，%s，修复了%d个文件，发现%d个问题，没有校验和的文件%d个，用时%s\n",
+		st.Files, formatSize(st.Bytes), st.Repaired, st.Problems, st.Unchecked, time.Since(st.Started).Round(time.Second))
+	return true
+}
+
+// 按filepath.WalkDir的顺序比较两个相对路径：逐级按名字比较，上级目录排在它下面的文件前面
+func walkLess(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// 是否已经要求停止。停止时解压可能返回别的错误（例如文件头读到一半），不能当作文件损坏
+func (s *scrubber) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// 卸载时停止后台巡检，记录进度，下次挂载时继续
+func (s *scrubber) shutdown() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+}
+
+// 显示速度上限
+func formatRate(rate int64) string {
+	if rate <= 0 {
+		return "不限制"
+	}
+	return formatSize(rate) + "/s"
+}
+
+// compressfs scrub [选项] BACKEND
+func runScrub(cmd *command, args []string) int {
+	fs := cmd.flagSet()
+	checkLegacy := addLegacyCodecFlag(fs)
+	rate := fs.String("rate", "0", help("maximum read rate, with optional K/M/G suffix per second, 0 means unlimited", "读取速度上限（每秒），可以带K/M/G单位，0表示不限制"))
+	workers := fs.Int("workers", runtime.NumCPU(), help("number of files checked in parallel", "同时检查的文件数"))
+	quiet := fs.Bool("quiet", false, help("do not print progress", "不显示进度"))
+	noRepair := fs.Bool("no-repair", false, help("only report damage that parity data can repair, do not write the repaired data back", "用纠错数据能修复的损坏只报告，不写回修复好的数据"))
+	if ok, code := cmd.parse(fs, args, 1, 1); !ok {
+		return code
+	}
+	if err := checkLegacy(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	limit, err := parseSize(*rate)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "速度参数错误！", err)
+		return 2
+	}
+	if *workers < 1 {
+		fmt.Fprintln(os.Stderr, "并发数参数错误！", *workers)
+		return 2
+	}
+	backend := filepath.Clean(fs.Arg(0))
+	if fi, err := os.Stat(backend); err != nil || !fi.IsDir() {
+		fmt.Fprintln(os.Stderr, "[ERROR]backend目录错误！", backend, err)
+		return 2
+	}
+
+	files, total, err := scanScrubFiles(backend)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		return 1
+	}
+	b := &batch{tag: "scrub", workers: *workers, quiet: *quiet, totalFiles: int64(len(files)), totalBytes: total}
+	fmt.Printf("[scrub]%d个文件，共%s，速度上限%s，并发数%d\n", len(files), formatSize(total), formatRate(limit), *workers)
+	l := newScrubLog(backend, true)
+	l.begin(int64(len(files)), total)
+	t := &throttle{rate: limit}
+	stop := make(chan struct{})
+	var saveMu sync.Mutex
+	lastSave := time.Now()
+	ok := b.run(len(files), func(i int) {
+		sf := files[i]
+		res := scrubOne(sf.path, t, stop, !*noRepair)
+		// 检查时被删除了不算问题。不知道压缩方式的旧格式文件没法检查，算作没有校验和的文件
+		if errors.Is(res.err, os.ErrNotExist) || errors.Is(res.err, errLegacyCodec) {
+			res.err = nil
+		}
+		rel, _ := filepath.Rel(backend, sf.path)
+		// 另起一行，不要接在进度后面
+		if (len(res.fixes) > 0 || res.err != nil) && !*quiet {
+			fmt.Println()
+		}
+		switch {
+		case res.repaired:
+			fmt.Printf("[scrub]用纠错数据修复了%s：%s\n", rel, formatFixes(res.fixes))
+		case len(res.fixes) > 0:
+			fmt.Printf("[scrub]%s可以用纠错数据修复（%s），但是没有修复\n", rel, formatFixes(res.fixes))
+		}
+		if res.err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR]%s：%v（偏移%d）\n", rel, res.err, res.off)
+			b.failed.Add(1)
+		}
+		b.bytesIn.Add(sf.size)
+		l.file(rel, sf.size, res)
+		saveMu.Lock()
+		if time.Since(lastSave) >= 10*time.Second {
+			lastSave = time.Now()
+			l.save()
+		}
+		saveMu.Unlock()
+	})
+	close(stop)
+	state, result := "done", "完成"
+	if !ok {
+		state, result = "interrupted", "已中断"
+	}
+	st := l.end(state)
+	fmt.Printf("[scrub]%s：%d个文件，%s，修复了%d个文件，发现%d个问题，没有校验和的文件%d个，结果记录在%s\n",
+		result, st.Files, formatSize(st.Bytes), st.Repaired, st.Problems, st.Unchecked,
+		filepath.Join(backend, metaDirName, "scrub"))
+	switch {
+	case !ok:
+		return 130
+	case st.Problems > 0:
+		return 1
+	}
+	return 0
+}
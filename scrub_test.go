@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// 在backend里建一些压缩文件，返回按WalkDir顺序排列的相对路径
+func makeScrubBackend(t *testing.T, names ...string) (string, []string) {
+	t.Helper()
+	backend := t.TempDir()
+	for _, name := range names {
+		path := filepath.Join(backend, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := encodeFile(&buf, bytes.NewReader([]byte(name)), int64(len(name)), "zstd"); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var walked []string
+	filepath.WalkDir(backend, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			rel, _ := filepath.Rel(backend, path)
+			walked = append(walked, rel)
+		}
+		return nil
+	})
+	return backend, walked
+}
+
+func TestWalkLess(t *testing.T) {
+	// "b/x"按字符串比较排在"b-c"后面，但是WalkDir先走完目录b
+	_, walked := makeScrubBackend(t, "c", "b-c", "b/y", "b/x", "a", "b.d/z", "b/x.y/1")
+	want := []string{"a", "b/x", "b/x.y/1", "b/y", "b-c", "b.d/z", "c"}
+	if !sort.SliceIsSorted(walked, func(i, j int) bool { return walkLess(walked[i], walked[j]) }) {
+		t.Fatalf("WalkDir的顺序%v和walkLess不一致", walked)
+	}
+	if len(walked) != len(want) {
+		t.Fatalf("walked = %v", walked)
+	}
+	for i := range want {
+		if walked[i] != want[i] {
+			t.Fatalf("walked = %v, want %v", walked, want)
+		}
+		if walkLess(want[i], want[i]) {
+			t.Errorf("walkLess(%q, %q)应该是false", want[i], want[i])
+		}
+	}
+	if !walkLess("", "a") || walkLess("a", "") {
+		t.Error("空路径应该排在最前面")
+	}
+}
+
+func TestScrubResume(t *testing.T) {
+	backend, _ := makeScrubBackend(t, "a", "b/x", "b/y", "b-c", "c")
+	// 已经检查过的文件坏了，继续的时候不应该再检查
+	if err := os.WriteFile(filepath.Join(backend, "a"), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &scrubber{stop: make(chan struct{})}
+	for _, tc := range []struct {
+		resume   string
+		files    int64
+		problems int64
+	}{
+		{"b/x", 2 + 3, 0}, // 接着检查b/y、b-c、c
+		{"b/w", 2 + 4, 0}, // 上一次检查到的文件已经删除了，从后面的b/x开始
+		{"b-c", 2 + 1, 0}, // 只剩c
+		{"", 5, 1},        // 从头开始，会发现a坏了
+		{"zzz", 5, 1},     // 后面没有文件了，重新从头开始
+	} {
+		last := scrubStatus{State: "interrupted", Files: 2, Last: tc.resume}
+		if !s.pass(backend, tc.resume, last) {
+			t.Fatal("pass被停止了")
+		}
+		st := loadScrubStatus(backend)
+		if st.State != "done" || st.Files != tc.files || st.Last != "c" {
+			t.Errorf("resume %q: state=%s files=%d last=%q，应该检查到%d个文件", tc.resume, st.State, st.Files, st.Last, tc.files)
+		}
+		if st.Problems != tc.problems {
+			t.Errorf("resume %q: problems = %d，应该是%d", tc.resume, st.Problems, tc.problems)
+		}
+	}
+}
+
+func TestScrubStop(t *testing.T) {
+	backend, _ := makeScrubBackend(t, "a", "b", "c")
+	s := &scrubber{stop: make(chan struct{})}
+	close(s.stop)
+	// 不限速时也要马上停下来，进度停在上一次检查到的文件
+	if (&throttle{}).wait(1, s.stop) || (*throttle)(nil).wait(1, s.stop) {
+		t.Fatal("stop关闭后wait应该返回false")
+	}
+	last := scrubStatus{State: "interrupted", Files: 1, Last: "a"}
+	if s.pass(backend, "a", last) {
+		t.Fatal("pass应该被停止")
+	}
+	st := loadScrubStatus(backend)
+	if st.State != "interrupted" || st.Files != 1 || st.Last != "a" {
+		t.Fatalf("state=%s files=%d last=%q，应该停在a", st.State, st.Files, st.Last)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// 特殊文件结构体：FIFO、socket、设备文件，继承了Node结构体。
+// 特殊文件没有数据，只有元数据，直接在BackendDir里创建一个同样的特殊文件保存。
+// 打开、读写特殊文件都由内核处理，不会到compressfs。
+type Special struct {
+	Node
+	mode os.FileMode // 文件类型
+}
+
+// 判断是不是特殊文件
+func isSpecialMode(mode os.FileMode) bool {
+	return mode&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice|os.ModeCharDevice) != 0
+}
+
+// 特殊文件的Attr()方法，直接返回BackendDir里特殊文件的属性
+func (s *Special) Attr(ctx context.Context, a *fuse.Attr) error {
+	fmt.Println("[Attr]", s.fullPath+s.name, "Inode:", s.inode)
+	if err := checkAccess(ctx); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(BackendDir + s.fullPath + s.name)
+	if err != nil {
+		return toErrno(err)
+	}
+	a.Inode = s.inode
+	a.Mode = fi.Mode()
+	a.Mtime = fi.ModTime()
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		a.Rdev = uint32(st.Rdev)
+	}
+	setOwner(a, fi)
+	overrideAttr(a)
+	return nil
+}
+
+// 创建特殊文件 https://godoc.org/bazil.org/fuse/fs#NodeMknoder
+// 设备文件需要以root（CAP_MKNOD）运行，否则返回 EPERM
+func (d *Dir) Mknod(ctx context.Context, req *fuse.MknodRequest) (fs.Node, error) {
+	fmt.Println("[Mknod]Dir:", d.fullPath, "Name:", req.Name, "Mode:", req.Mode, "Rdev:", req.Rdev)
+	if err := checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkAccess(ctx); err != nil {
+		return nil, err
+	}
+	if err := d.checkName(req.Name); err != nil {
+		return nil, err
+	}
+	treeLock.Lock()
+	defer treeLock.Unlock()
+	if d.exists(req.Name) {
+		return nil, fuse.EEXIST
+	}
+	path := BackendDir + d.fullPath + req.Name
+	perm := req.Mode.Perm() &^ req.Umask
+	inode := NewInode()
+	// 普通文件：创建一个空的压缩文件
+	if !isSpecialMode(req.Mode) {
+		if err := createEmpty(path, perm); err != nil {
+			fmt.Println("[ERROR]创建文件失败！", err)
+			return nil, toErrno(err)
+		}
+		f := &File{
+			Node: Node{
+				name:     req.Name,
+				inode:    inode,
+				fullPath: d.fullPath,
+			},
+		}
+		inodeMap[inode] = f
+		d.files[f.name] = f
+		return f, nil
+	}
+	if err := syscall.Mknod(path, unixMode(req.Mode.Type()|perm), int(req.Rdev)); err != nil {
+		fmt.Println("[ERROR]创建特殊文件失败！", err)
+		return nil, toErrno(err)
+	}
+	s := &Special{
+		Node: Node{
+			name:     req.Name,
+			inode:    inode,
+			fullPath: d.fullPath,
+		},
+		mode: req.Mode.Type(),
+	}
+	inodeMap[inode] = s
+	d.specials[s.name] = s
+	return s, nil
+}
+
+// 创建一个空文件，里面只有文件头和结束记录
+func createEmpty(path string, perm os.FileMode) error {
+	fc, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	err = encodeFile(fc, bytes.NewReader(nil), 0, CompressType)
+	if cerr := fc.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// 把os.FileMode转换成mknod(2)需要的mode
+func unixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		m |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		m |= syscall.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		m |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		m |= syscall.S_IFBLK
+	default:
+		m |= syscall.S_IFREG
+	}
+	return m
+}
+
+// 目录项的类型
+func direntType(mode os.FileMode) fuse.DirentType {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return fuse.DT_FIFO
+	case mode&os.ModeSocket != 0:
+		return fuse.DT_Socket
+	case mode&os.ModeCharDevice != 0:
+		return fuse.DT_Char
+	case mode&os.ModeDevice != 0:
+		return fuse.DT_Block
+	}
+	return fuse.DT_Unknown
+}
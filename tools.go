@@ -5,58 +5,276 @@ import (
 	"compress/gzip"
 	"compress/lzw"
 	"compress/zlib"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/klauspost/compress/zstd"
 )
 
-// 获取文件大小
-func getFileSize(filepath string) uint64 {
-	f, err := os.Open(filepath)
-	if err != nil {
-		fmt.Println("[getFileSize ERROR]文件大小读取错误！", err)
-		return uint64(0)
+// 把后端返回的错误转换成FUSE的错误码（ENOSPC、EACCES、ENOENT、EEXIST等），
+// 压缩数据损坏之类没有对应错误码的错误返回 EIO。否则bazil.org/fuse只会返回EIO
+func toErrno(err error) error {
+	if err == nil {
+		return nil
+	}
+	var errno fuse.ErrorNumber
+	if errors.As(err, &errno) {
+		return err
+	}
+	var se syscall.Errno
+	if errors.As(err, &se) {
+		return fuse.Errno(se)
 	}
-	file_size, err := f.Seek(0, os.SEEK_END)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fuse.ENOENT
+	case errors.Is(err, os.ErrExist):
+		return fuse.EEXIST
+	case errors.Is(err, os.ErrPermission):
+		return fuse.Errno(syscall.EACCES)
+	}
+	return fuse.EIO
+}
+
+// 压缩时使用的临时文件名，写完后rename成真正的文件名
+const tempPattern = ".compressfs-*.tmp"
+
+// 判断是不是压缩时使用的临时文件
+func isTempName(name string) bool {
+	return strings.HasPrefix(name, ".compressfs-") && strings.HasSuffix(name, ".tmp")
+}
+
+// backend根目录下保存compressfs自己的数据（fsck的隔离区等）的目录，挂载后看不到
+const metaDirName = ".compressfs"
+
+// 判断是不是backend根目录下的.compressfs目录
+func isMetaDir(backend, path string) bool {
+	return filepath.Clean(path) == filepath.Join(backend, metaDirName)
+}
+
+// 旧版本（解压后的文件放在BackendDir里时）的解压文件的后缀，异常退出时会留在BackendDir里
+const legacyRawSuffix = ".compressfs.raw"
+
+// 把文件同步到磁盘
+func syncFile(path string) error {
+	f, err := os.Open(path)
 	if err != nil {
-		fmt.Println("[getFileSize ERROR]Seek发生错误！", err)
-		os.Exit(1)
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// 把目录同步到磁盘，保证目录下的rename、创建、删除等操作已经落盘
+func syncDir(path string) error {
+	return syncFile(path)
+}
+
+// 解析带单位的大小，例如 512M、2G，不带单位则为字节
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	unit := int64(1)
+	for i, u := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(s, u) {
+			s = strings.TrimSuffix(s, u)
+			unit = int64(1) << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("无效的大小：%q", s)
 	}
-	return uint64(file_size)
+	return n * unit, nil
 }
 
-// 根据 CompressType ，返回对应的 Reader
+// 旧版本写的（没有文件头的）压缩文件的压缩方式，为空时和 CompressType 相同。
+// 旧版本整个backend只用一种压缩方式，就是挂载时指定的那个，所以挂载时默认和 -codec 相同
+var LegacyCodec string
+
+// 没有 -codec 的离线命令（export、fsck等）遇到旧格式的文件，又没有指定 -legacy-codec
+var errLegacyCodec = errors.New("没有文件头的旧格式文件，需要用-legacy-codec指定压缩方式")
+
+// 返回旧格式文件的 Reader，压缩方式为 LegacyCodec（没有设置时为 CompressType）
 func NewReader(r io.Reader) (io.ReadCloser, error) {
+	codec := LegacyCodec
+	if codec == "" {
+		codec = CompressType
+	}
+	if codec == "" {
+		return nil, errLegacyCodec
+	}
+	return newCodecReader(codec, r)
+}
+
+// 转换、修复旧格式的文件时用的 Reader，必须明确指定了 LegacyCodec。
+// 压缩方式猜错的话解压出来的可能是错的数据，替换之后原来的文件就没有了
+func explicitLegacyReader(r io.Reader) (io.ReadCloser, error) {
+	if LegacyCodec == "" {
+		return nil, errLegacyCodec
+	}
+	return newCodecReader(LegacyCodec, r)
+}
+
+// 每种压缩方式的级别范围和默认级别，lzw没有级别
+var codecLevels = map[string][3]int{
+	"flate": {1, 9, 6},
+	"gzip":  {1, 9, 9},
+	"zlib":  {1, 9, 9},
+	"zstd":  {1, 22, 3},
+}
+
+// 解析压缩方式，写成 名字[:级别]，例如 zstd:9、gzip:6。flate1、flate9是以前的写法，单独作为名字。
+// 没有写级别时返回默认级别。逗号后面的选项（例如parity=10%）由 parseCodecSpec 解析，这里忽略
+func parseCodec(spec string) (name string, level int, err error) {
+	spec, _, _ = strings.Cut(spec, ",")
+	name, levelStr, hasLevel := strings.Cut(spec, ":")
+	switch name {
+	case "lzw", "flate1", "flate9":
+		if hasLevel {
+			return "", 0, fmt.Errorf("压缩方式%s不能指定级别：%q", name, spec)
+		}
+		return name, 0, nil
+	}
+	levels, ok := codecLevels[name]
+	if !ok {
+		return "", 0, fmt.Errorf("未知的压缩方式：%q", spec)
+	}
+	if !hasLevel {
+		return name, levels[2], nil
+	}
+	level, err = strconv.Atoi(levelStr)
+	if err != nil || level < levels[0] || level > levels[1] {
+		return "", 0, fmt.Errorf("压缩方式%s的级别必须是%d到%d：%q", name, levels[0], levels[1], spec)
+	}
+	return name, level, nil
+}
+
+// 解析压缩设置：压缩方式后面可以用逗号加选项，目前只有parity=N%，每组数据额外保存N%的纠错数据（1-100），
+// 例如 zstd:9,parity=10%。返回压缩方式（不带选项）和parity，没有设置时parity为0
+func parseCodecSpec(spec string) (codec string, parity int, err error) {
+	codec, options, _ := strings.Cut(spec, ",")
+	if _, _, err := parseCodec(codec); err != nil {
+		return "", 0, err
+	}
+	for _, opt := range strings.Split(options, ",") {
+		if opt == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(opt, "=")
+		if key != "parity" {
+			return "", 0, fmt.Errorf("未知的压缩选项：%q", opt)
+		}
+		parity, err = strconv.Atoi(strings.TrimSuffix(value, "%"))
+		if err != nil || parity < 1 || parity > 100 {
+			return "", 0, fmt.Errorf("parity必须是1%%到100%%：%q", opt)
+		}
+	}
+	return codec, parity, nil
+}
+
+// 返回压缩设置的规范写法：默认级别不写出来，例如 zstd:3 -> zstd、gzip:6 -> gzip:6、zstd:3,parity=10 -> zstd,parity=10%。
+// 写入文件头、判断文件需不需要转换都用规范写法
+func canonicalCodec(spec string) (string, error) {
+	codec, parity, err := parseCodecSpec(spec)
+	if err != nil {
+		return "", err
+	}
+	name, level, _ := parseCodec(codec)
+	if levels, ok := codecLevels[name]; ok && level != levels[2] {
+		name += ":" + strconv.Itoa(level)
+	}
+	if parity > 0 {
+		name += fmt.Sprintf(",parity=%d%%", parity)
+	}
+	return name, nil
+}
+
+// 判断是不是支持的压缩设置
+func validCodec(codec string) bool {
+	_, _, err := parseCodecSpec(codec)
+	return err == nil
+}
+
+// 根据压缩方式，返回对应的 Reader。解压不需要级别
+func newCodecReader(codec string, r io.Reader) (io.ReadCloser, error) {
+	name, _, err := parseCodec(codec)
+	if err != nil {
+		return nil, err
+	}
 	// 注意：lzw.NewReader、flate.NewReader不返回error，所以这里添加了nil
-	switch CompressType {
+	switch name {
 	case "lzw":
 		return lzw.NewReader(r, lzw.LSB, 8), nil
-	case "flate1":
-		return flate.NewReader(r), nil
-	case "flate9":
+	case "flate", "flate1", "flate9":
 		return flate.NewReader(r), nil
 	case "gzip":
 		return gzip.NewReader(r)
 	case "zlib":
 		return zlib.NewReader(r)
+	case "zstd":
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
 	}
-	return nil, nil // 正常不应该执行到这里
+	return nil, fmt.Errorf("未知的压缩方式：%q", codec)
 }
 
-// 根据 CompressType ，返回对应的 Writer
-func NewWriter(w io.Writer) (io.WriteCloser, error) {
+// 根据压缩方式，返回对应的 Writer
+func newCodecWriter(codec string, w io.Writer) (io.WriteCloser, error) {
+	name, level, err := parseCodec(codec)
+	if err != nil {
+		return nil, err
+	}
 	// 注意：lzw.NewWriter不返回error，所以这里添加了nil
-	switch CompressType {
+	switch name {
 	case "lzw":
 		return lzw.NewWriter(w, lzw.LSB, 8), nil
 	case "flate1":
 		return flate.NewWriter(w, flate.BestSpeed)
 	case "flate9":
 		return flate.NewWriter(w, flate.BestCompression)
+	case "flate":
+		return flate.NewWriter(w, level)
 	case "gzip":
-		return gzip.NewWriterLevel(w, gzip.BestCompression)
+		return gzip.NewWriterLevel(w, level)
 	case "zlib":
-		return zlib.NewWriterLevel(w, zlib.BestCompression)
+		return zlib.NewWriterLevel(w, level)
+	case "zstd":
+		// 每块单独压缩，窗口不需要比块大
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+			zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(blockSize))
+	}
+	return nil, fmt.Errorf("未知的压缩方式：%q", codec)
+}
+
+// 把字节数格式化成带单位的大小，例如 1.5 MiB
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// 压缩后的大小占压缩前的百分比
+func formatRatio(compressed, logical int64) string {
+	if logical == 0 {
+		return "-"
 	}
-	return nil, nil // 正常不应该执行到这里
+	return fmt.Sprintf("%.1f%%", float64(compressed)*100/float64(logical))
 }
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"0": 0, "512": 512, "4K": 4 << 10, "4k": 4 << 10, "8M": 8 << 20, "8MB": 8 << 20,
+		" 2G ": 2 << 30, "1T": 1 << 40,
+	} {
+		if got, err := parseSize(in); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v，应该是%d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "-1", "1X", "1.5G", "G"} {
+		if _, err := parseSize(in); err == nil {
+			t.Errorf("parseSize(%q)应该报错", in)
+		}
+	}
+}
+
+func TestCanonicalCodec(t *testing.T) {
+	for in, want := range map[string]string{
+		"lzw": "lzw", "flate1": "flate1", "flate9": "flate9",
+		"flate": "flate", "flate:6": "flate", "flate:1": "flate:1",
+		"gzip:9": "gzip", "gzip:6": "gzip:6", "zlib": "zlib",
+		"zstd": "zstd", "zstd:3": "zstd", "zstd:19": "zstd:19",
+		"zstd,parity=10": "zstd,parity=10%", "zstd:3,parity=10%": "zstd,parity=10%",
+		"zstd:9,parity=5%": "zstd:9,parity=5%", "gzip:9,": "gzip",
+	} {
+		got, err := canonicalCodec(in)
+		if err != nil || got != want {
+			t.Errorf("canonicalCodec(%q) = %q, %v，应该是%q", in, got, err, want)
+			continue
+		}
+		// 规范写法再规范一次不变，解析出来的名字和级别也一样
+		if again, err := canonicalCodec(got); err != nil || again != got {
+			t.Errorf("canonicalCodec(%q) = %q, %v，规范写法应该不变", got, again, err)
+		}
+		c1, p1, _ := parseCodecSpec(in)
+		c2, p2, _ := parseCodecSpec(got)
+		n1, l1, _ := parseCodec(c1)
+		n2, l2, _ := parseCodec(c2)
+		if n1 != n2 || l1 != l2 || p1 != p2 {
+			t.Errorf("%q和%q解析出来不一样：%s:%d,%d%%、%s:%d,%d%%", in, got, n1, l1, p1, n2, l2, p2)
+		}
+	}
+	for _, in := range []string{"", "bzip2", "lzw:3", "flate9:1", "gzip:0", "gzip:10", "zstd:23", "zstd:x",
+		"zstd,parity=0", "zstd,parity=101%", "zstd,parity=x", "zstd,parity", "zstd,level=3"} {
+		if validCodec(in) {
+			t.Errorf("%q不应该是合法的压缩方式", in)
+		}
+	}
+}
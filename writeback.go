@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 写回延迟：文件关闭后，等这么久没有再修改才在后台重新压缩。0表示关闭文件时同步压缩
+var WritebackDelay time.Duration
+
+// 后台压缩的并发数
+var WritebackWorkers int
+
+// 后台压缩。Release只把文件标记为脏，由后台按写回延迟或者缓存压力把文件重新压缩
+type writeback struct {
+	mu       sync.Mutex
+	dirty    map[uint64]*File // 等待压缩的文件
+	queue    chan *File       // 交给worker压缩的文件
+	kickChan chan struct{}    // 让调度马上检查一次
+	stop     chan struct{}
+	loopDone chan struct{}
+	wg       sync.WaitGroup
+}
+
+var wb = writeback{
+	dirty:    make(map[uint64]*File),
+	kickChan: make(chan struct{}, 1),
+}
+
+// 启动调度和worker，WritebackDelay为0时不启动
+func (w *writeback) start() {
+	if WritebackDelay <= 0 {
+		return
+	}
+	if WritebackWorkers < 1 {
+		WritebackWorkers = 1
+	}
+	w.queue = make(chan *File)
+	w.stop = make(chan struct{})
+	w.loopDone = make(chan struct{})
+	for i := 0; i < WritebackWorkers; i++ {
+		w.wg.Add(1)
+		go w.worker()
+	}
+	go w.loop()
+}
+
+// 把文件标记为脏，等待后台压缩。调用时需持有f.mu
+func (w *writeback) mark(f *File) {
+	f.dirtyTime = time.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dirty[f.inode] = f
+}
+
+// 文件被删除了，不用再压缩
+func (w *writeback) forget(f *File) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.dirty, f.inode)
+}
+
+// 让调度马上检查一次（例如缓存空间不足时）
+func (w *writeback) kick() {
+	select {
+	case w.kickChan <- struct{}{}:
+	default:
+	}
+}
+
+// 定期检查有没有到期的脏文件
+func (w *writeback) loop() {
+	interval := WritebackDelay / 2
+	if interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			close(w.loopDone)
+			return
+		case <-ticker.C:
+		case <-w.kickChan:
+		}
+		w.schedule(cachePressure())
+	}
+}
+
+// 把已经关闭、并且超过写回延迟没有修改的脏文件交给worker。all为true时不管延迟，全部压缩
+func (w *writeback) schedule(all bool) {
+	now := time.Now()
+	var due []*File
+	w.mu.Lock()
+	for inode, f := range w.dirty {
+		if !f.mu.TryLock() {
+			continue
+		}
+		if f.openCount == 0 && (all || now.Sub(f.dirtyTime) >= WritebackDelay) {
+			due = append(due, f)
+			delete(w.dirty, inode)
+		}
+		f.mu.Unlock()
+	}
+	w.mu.Unlock()
+	for _, f := range due {
+		w.queue <- f
+	}
+}
+
+// 后台压缩文件
+func (w *writeback) worker() {
+	defer w.wg.Done()
+	for f := range w.queue {
+		f.mu.Lock()
+		// 文件又被打开了，等它关闭的时候会重新标记
+		if f.modified && f.openCount == 0 {
+			fmt.Println("[writeback]压缩文件", f.fullPath+f.name, "Size:", f.rawSize)
+			if err := f.compress(false); err != nil {
+				fmt.Println("[ERROR]后台压缩文件失败！", f.name, err.Error())
+				w.mark(f)
+			}
+		}
+		f.mu.Unlock()
+		cache.evict()
+	}
+}
+
+// 卸载时停止调度，把所有脏文件压缩完再返回
+func (w *writeback) shutdown() {
+	if w.queue == nil {
+		return
+	}
+	close(w.stop)
+	<-w.loopDone
+	fmt.Println("[writeback]压缩所有修改过的文件")
+	w.schedule(true)
+	close(w.queue)
+	w.wg.Wait()
+	// 压缩失败（例如磁盘满了）的文件再试一次，还是失败的话解压文件留在缓存目录里，下次挂载时写回
+	for _, f := range w.dirty {
+		f.mu.Lock()
+		if f.modified {
+			if err := f.compress(false); err != nil {
+				fmt.Println("[ERROR]压缩文件失败！", f.name, err.Error())
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+// 缓存占用超过上限的90%，或者缓存目录所在磁盘剩余空间不足5%时，认为有压力，需要尽快压缩
+func cachePressure() bool {
+	cache.mu.Lock()
+	used := cache.used
+	cache.mu.Unlock()
+	if CacheSize > 0 && used > CacheSize/10*9 {
+		return true
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(cacheMountDir, &st); err == nil && st.Blocks > 0 && st.Bavail*20 < st.Blocks {
+		return true
+	}
+	return false
+}